@@ -5,8 +5,16 @@ go 1.13
 require (
 	code.cloudfoundry.org/lager v2.0.0+incompatible
 	github.com/aiven/aiven-go-client v1.2.1-0.20191201213302-a1623b13193c
+	github.com/alphagov/paas-observability-release/src/atomicfile v0.0.0
+	github.com/alphagov/paas-observability-release/src/health v0.0.0
 	github.com/jarcoal/httpmock v1.0.4
 	github.com/onsi/ginkgo v1.10.3
 	github.com/onsi/gomega v1.7.1
 	github.com/prometheus/client_golang v1.2.1
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
+	golang.org/x/net v0.0.0-20190613194153-d28f0bde5980
 )
+
+replace github.com/alphagov/paas-observability-release/src/atomicfile => ../atomicfile
+
+replace github.com/alphagov/paas-observability-release/src/health => ../health
@@ -8,108 +8,235 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/alphagov/paas-observability-release/src/health"
+
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/aivenapi"
+	c "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/config"
 	d "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/discoverer"
 	f "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/fetcher"
 	i "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/integrator"
 	r "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/resolver"
 )
 
-const (
-	discoveryLoopInterval = 120 * time.Second
-)
-
 var (
-	aivenAPIToken              string
-	aivenProject               string
-	aivenPrometheusEndpointID  string
-	serviceDiscoveryTargetPath string
-	prometheusListenPort       uint
+	configPath           string
+	prometheusListenPort uint
+
+	fetchStalenessThreshold time.Duration
+	writeStalenessThreshold time.Duration
+
+	staleTargetGracePeriod time.Duration
+
+	dryRun bool
 )
 
 func main() {
-	flag.StringVar(&aivenAPIToken, "aiven-api-token", "", "Aiven API token use")
-	flag.StringVar(&aivenProject, "aiven-project", "", "Aiven project to discover")
-	flag.StringVar(&aivenPrometheusEndpointID, "aiven-prometheus-endpoint-id", "", "Aiven Prometheus service integration endpoint to use")
-	flag.StringVar(&serviceDiscoveryTargetPath, "service-discovery-target-path", "", "File path to where targets will be written")
+	flag.StringVar(&configPath, "config", "", "File path to the JSON config listing the Aiven projects to discover")
 	flag.UintVar(&prometheusListenPort, "prometheus-listen-port", 9274, "Port on which prometheus metrics will be exposed via /metrics")
+	flag.DurationVar(&fetchStalenessThreshold, "fetch-staleness-threshold", 10*time.Minute, "Duration after the last successful fetch of a project at which /healthz fails")
+	flag.DurationVar(&writeStalenessThreshold, "write-staleness-threshold", 5*time.Minute, "Duration after the last successful write of targets at which /healthz fails")
+	flag.DurationVar(&staleTargetGracePeriod, "stale-target-grace-period", 10*time.Minute, "Duration for which the last known good IPs of a service are used, with the label aiven_stale=\"true\", when it can not be resolved")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log and count the changes the integrator would make to Aiven, and serve them from /debug/planned-actions, without making them")
 	flag.Parse()
 
-	if aivenAPIToken == "" {
-		log.Fatalf("Flag not specified: --aiven-api-token")
+	if configPath == "" {
+		log.Fatalf("Flag not specified: --config")
 	}
 
-	if aivenProject == "" {
-		log.Fatalf("Flag not specified: --aiven-project")
+	if 0 == prometheusListenPort || prometheusListenPort > 65535 {
+		log.Fatalf("Flag invalid: --prometheus-listen-port must be between 1 and 65535")
 	}
 
-	if aivenPrometheusEndpointID == "" {
-		log.Fatalf("Flag not specified: --aiven-prometheus-endpoint-id")
+	if fetchStalenessThreshold <= 0 || writeStalenessThreshold <= 0 {
+		log.Fatalf("Flag invalid: --fetch-staleness-threshold and --write-staleness-threshold must be positive")
 	}
 
-	if serviceDiscoveryTargetPath == "" {
-		log.Fatalf("Flag not specified: --service-discovery-target-path")
+	if staleTargetGracePeriod < 0 {
+		log.Fatalf("Flag invalid: --stale-target-grace-period must not be negative")
 	}
 
-	if 0 == prometheusListenPort || prometheusListenPort > 65535 {
-		log.Fatalf("Flag invalid: --prometheus-listen-port must be between 1 and 65535")
+	cfg, err := c.LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Could not load config: %s", err)
 	}
 
 	logger := lager.NewLogger("aiven-service-discovery")
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.INFO))
 
-	fetcher, err := f.NewFetcher(
-		aivenProject, aivenAPIToken,
-		logger,
-	)
-	if err != nil {
-		log.Fatalf("Could not create fetcher: %s", err)
+	ctx, shutdown := context.WithCancel(context.Background())
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+		<-sigChan
+		shutdown()
+	}()
+
+	checker := health.NewChecker()
+
+	serviceTypes := i.NewServiceTypes(cfg.ServiceTypes.Allow, cfg.ServiceTypes.Deny)
+	reconcile := i.Reconcile{
+		Enabled:      cfg.Reconcile.Enabled,
+		RemoveDenied: cfg.Reconcile.RemoveDenied,
+		DryRun:       cfg.Reconcile.DryRun || dryRun,
+	}
+
+	fetchers := make(map[string]f.Fetcher)
+	integrators := make([]i.Integrator, 0)
+	discoverers := make([]d.Discoverer, 0)
+
+	for _, project := range cfg.Projects {
+		fetcher, err := f.NewFetcher(
+			project.Name, project.APIToken,
+			aivenapi.DefaultBackoff,
+			logger,
+		)
+		if err != nil {
+			log.Fatalf("Could not create fetcher for %s: %s", project.Name, err)
+		}
+		fetchers[project.Name] = fetcher
+		checker.Register("fetch-"+project.Name, fetchStalenessThreshold, fetcher.LastSuccess)
+
+		integrator, err := i.NewIntegrator(
+			project.Name, project.APIToken, project.PrometheusEndpointID,
+			aivenapi.DefaultBackoff,
+			serviceTypes,
+			reconcile,
+			dryRun,
+			fetcher,
+			logger,
+		)
+		if err != nil {
+			log.Fatalf("Could not create integrator for %s: %s", project.Name, err)
+		}
+		integrators = append(integrators, integrator)
 	}
 
-	integrator, err := i.NewIntegrator(
-		aivenProject, aivenAPIToken, aivenPrometheusEndpointID,
-		fetcher,
-		logger,
+	dnsTimeout, err := cfg.DNS.TimeoutDuration()
+	if err != nil {
+		log.Fatalf("Could not parse DNS timeout: %s", err)
+	}
+	resolver, err := r.NewResolver(
+		cfg.DNS.Servers,
+		dnsTimeout,
+		cfg.DNS.Retries,
+		cfg.DNS.Family,
 	)
 	if err != nil {
-		log.Fatalf("Could not create integrator: %s", err)
+		log.Fatalf("Could not create resolver: %s", err)
+	}
+
+	scrapeConfigs := make(d.ScrapeConfigs)
+	for serviceType, scrapeConfig := range cfg.ScrapeConfigs {
+		scrapeConfigs[serviceType] = d.ScrapeConfig{
+			Port:        scrapeConfig.Port,
+			Scheme:      scrapeConfig.Scheme,
+			MetricsPath: scrapeConfig.MetricsPath,
+		}
 	}
 
-	discoverer, err := d.NewDiscoverer(
-		aivenProject, serviceDiscoveryTargetPath,
-		fetcher, r.NewResolver(),
-		logger,
+	serviceFilter, err := d.NewServiceFilter(
+		cfg.ServiceFilter.ExcludeStates,
+		cfg.ServiceFilter.IncludeNameRegex,
+		cfg.ServiceFilter.ExcludeNameRegex,
+		cfg.ServiceFilter.ServiceTypes,
 	)
 	if err != nil {
-		log.Fatalf("Could not create discoverer: %s", err)
+		log.Fatalf("Could not create service filter: %s", err)
+	}
+
+	labelMappings := make(d.LabelMappings, 0, len(cfg.Labels))
+	for _, label := range cfg.Labels {
+		labelMappings = append(labelMappings, d.LabelMapping{
+			Label: label.Label,
+			Field: label.Field,
+		})
+	}
+
+	for targetPath, projects := range cfg.ProjectsByTargetPath() {
+		projectFetchers := make([]f.Fetcher, 0)
+		for _, project := range projects {
+			projectFetchers = append(projectFetchers, fetchers[project.Name])
+		}
+
+		discoverer, err := d.NewDiscoverer(
+			targetPath,
+			projectFetchers, resolver,
+			serviceFilter,
+			scrapeConfigs,
+			labelMappings,
+			staleTargetGracePeriod,
+			logger,
+		)
+		if err != nil {
+			log.Fatalf("Could not create discoverer for %s: %s", targetPath, err)
+		}
+		discoverers = append(discoverers, discoverer)
+		checkName := "write-" + targetPath
+		if targetPath == "" {
+			checkName = "discover"
+		}
+		checker.Register(checkName, writeStalenessThreshold, discoverer.LastSuccess)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	checker.Handle(mux)
+
+	if reconcile.DryRun {
+		mux.Handle("/debug/planned-actions", i.NewPlannedActionsHandler(integrators))
+	}
+
+	if cfg.HTTPSD {
+		mux.Handle("/http_sd", d.NewHTTPSDHandler(discoverers))
 	}
 
 	metricsServer := &http.Server{
 		Addr:    fmt.Sprintf(":%d", prometheusListenPort),
-		Handler: promhttp.Handler(),
+		Handler: mux,
 	}
 
 	go func() {
 		err := metricsServer.ListenAndServe()
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Could not listen and serve metrics: %s", err)
 		}
 	}()
 
-	fetcher.Start()
-	integrator.Start()
-	discoverer.Start()
+	// The fetchers fetch synchronously when they start, and notify the
+	// integrators and discoverers, so that they begin with the fetched
+	// services rather than waiting for their intervals
+	for _, fetcher := range fetchers {
+		fetcher.Start(ctx)
+	}
+	for _, integrator := range integrators {
+		integrator.Start(ctx)
+	}
+	for _, discoverer := range discoverers {
+		discoverer.Start(ctx)
+	}
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-	<-interrupt
+	<-ctx.Done()
+	logger.Info("shutting-down")
 
-	fetcher.Stop()
-	integrator.Stop()
-	discoverer.Stop()
-	metricsServer.Shutdown(context.Background())
+	// The components were started with the cancelled context, so stopping
+	// them only waits for their in-flight calls to be cancelled
+	for _, fetcher := range fetchers {
+		fetcher.Stop()
+	}
+	for _, integrator := range integrators {
+		integrator.Stop()
+	}
+	for _, discoverer := range discoverers {
+		discoverer.Stop()
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	metricsServer.Shutdown(shutdownCtx)
 }
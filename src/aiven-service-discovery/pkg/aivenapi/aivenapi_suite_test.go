@@ -0,0 +1,13 @@
+package aivenapi_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestAivenAPI(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Aiven API Suite")
+}
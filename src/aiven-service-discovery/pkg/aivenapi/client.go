@@ -0,0 +1,74 @@
+package aivenapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	aiven "github.com/aiven/aiven-go-client"
+)
+
+func init() {
+	initMetrics()
+}
+
+// DefaultTimeout bounds each call to the Aiven API, including its retries
+const DefaultTimeout = 30 * time.Second
+
+// NewClient returns an Aiven client authenticated by the token, whose calls
+// are retried with the backoff
+func NewClient(token string, userAgent string, backoff Backoff) (*aiven.Client, error) {
+	client, err := aiven.NewTokenClient(token, userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Client = &http.Client{
+		Transport: &retryTransport{backoff: backoff},
+	}
+
+	return client, nil
+}
+
+// WithTimeout returns a copy of the client whose calls are cancelled after
+// the timeout, or when the context is done. The Aiven client does not accept
+// a context, so the context is attached to each request by its transport.
+// The cancel func must be called once the calls have been made
+func WithTimeout(
+	ctx context.Context,
+	client aiven.Client,
+	timeout time.Duration,
+) (*aiven.Client, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	var next http.RoundTripper
+	if client.Client != nil {
+		next = client.Client.Transport
+	}
+
+	client.Client = &http.Client{
+		Transport: &contextTransport{ctx: ctx, next: next},
+	}
+
+	// The handlers point at the client they were created by, so they must
+	// be created again for the copy
+	client.Init()
+
+	return &client, cancel
+}
+
+type contextTransport struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The default transport is looked up for each request, rather than when
+	// the client is copied, so that it can be replaced in tests
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	return next.RoundTrip(req.WithContext(t.ctx))
+}
@@ -0,0 +1,96 @@
+package aivenapi_test
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/jarcoal/httpmock"
+
+	aiven "github.com/aiven/aiven-go-client"
+
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/aivenapi"
+)
+
+const (
+	project = "my-aiven-project"
+	token   = "my-aiven-api-token"
+
+	listServicesURL = "https://api.aiven.io/v1/project/my-aiven-project/service"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		client *aiven.Client
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		httpmock.Activate()
+
+		client, err = aiven.NewTokenClient(token, "aivenapi-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		httpmock.DeactivateAndReset()
+	})
+
+	It("should give each request a deadline", func() {
+		var deadline time.Time
+
+		httpmock.RegisterResponder(
+			"GET", listServicesURL,
+			func(req *http.Request) (*http.Response, error) {
+				deadline, _ = req.Context().Deadline()
+				return httpmock.NewJsonResponse(200, map[string]interface{}{
+					"services": []interface{}{},
+				})
+			},
+		)
+
+		c, cancel := aivenapi.WithTimeout(context.Background(), *client, time.Minute)
+		defer cancel()
+
+		_, err := c.Services.List(project)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(deadline).To(BeTemporally("~", time.Now().Add(time.Minute), 5*time.Second))
+	})
+
+	It("should cancel requests when the context is done", func() {
+		httpmock.RegisterResponder(
+			"GET", listServicesURL,
+			func(req *http.Request) (*http.Response, error) {
+				<-req.Context().Done()
+				return nil, req.Context().Err()
+			},
+		)
+
+		ctx, cancelCtx := context.WithCancel(context.Background())
+
+		c, cancel := aivenapi.WithTimeout(ctx, *client, time.Minute)
+		defer cancel()
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancelCtx()
+		}()
+
+		_, err := c.Services.List(project)
+		Expect(err).To(MatchError(ContainSubstring("context canceled")))
+	})
+
+	It("should not change the original client", func() {
+		c, cancel := aivenapi.WithTimeout(context.Background(), *client, time.Minute)
+		defer cancel()
+
+		Expect(c.Client).NotTo(BeIdenticalTo(client.Client))
+		Expect(client.Services).NotTo(BeIdenticalTo(c.Services))
+		Expect(client.Client.Transport).To(BeNil())
+	})
+})
@@ -0,0 +1,44 @@
+package aivenapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	aiven "github.com/aiven/aiven-go-client"
+)
+
+const (
+	StatusClassTimeout   = "timeout"
+	StatusClassCancelled = "cancelled"
+	StatusClassOther     = "other"
+)
+
+// StatusClass is the class of the HTTP status, such as 4xx or 5xx, of a
+// failed call to the Aiven API, so that rate limiting can be told apart
+// from outages. Calls which failed without a status are a timeout when
+// their deadline was exceeded, cancelled, or other
+func StatusClass(err error) string {
+	var aivenErr aiven.Error
+	if errors.As(err, &aivenErr) {
+		return statusCodeClass(aivenErr.Status)
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusCodeClass(statusErr.StatusCode)
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return StatusClassTimeout
+	case errors.Is(err, context.Canceled):
+		return StatusClassCancelled
+	default:
+		return StatusClassOther
+	}
+}
+
+func statusCodeClass(statusCode int) string {
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
@@ -0,0 +1,16 @@
+package aivenapi
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	AivenAPIRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aiven_api_retries_total",
+		Help: "Counter of total number of calls to the Aiven API which were retried, by the HTTP status class of the failure",
+	}, []string{"status_class"})
+)
+
+func initMetrics() {
+	prometheus.MustRegister(AivenAPIRetriesTotal)
+}
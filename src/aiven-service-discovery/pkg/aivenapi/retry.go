@@ -0,0 +1,198 @@
+package aivenapi
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxErrorMessageSize bounds how much of the body of a failed response is
+// kept in a StatusError
+const maxErrorMessageSize = 4096
+
+// Backoff is how calls to the Aiven API are retried when they are rate
+// limited, when Aiven fails, or when they do not reach Aiven. The interval
+// before each retry grows by the exponent, up to the max interval, with up
+// to the jitter added so that many clients do not retry together. When
+// Aiven says how long to wait with a Retry-After header, that is used
+// instead
+type Backoff struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Exponent        float64
+	Jitter          time.Duration
+	MaxRetries      int
+}
+
+var DefaultBackoff = Backoff{
+	InitialInterval: 1 * time.Second,
+	MaxInterval:     10 * time.Second,
+	Exponent:        2,
+	Jitter:          500 * time.Millisecond,
+	MaxRetries:      3,
+}
+
+// interval is how long to wait before the retry, which starts at zero
+func (b Backoff) interval(retry int) time.Duration {
+	interval := float64(b.InitialInterval) * math.Pow(b.Exponent, float64(retry))
+	if interval > float64(b.MaxInterval) {
+		interval = float64(b.MaxInterval)
+	}
+
+	if b.Jitter > 0 {
+		interval += float64(rand.Int63n(int64(b.Jitter)))
+	}
+
+	return time.Duration(interval)
+}
+
+// StatusError is returned when a call which is retried still fails once the
+// retries are exhausted. It is returned as an error, rather than as the
+// response, so that the Aiven client does not retry the call again itself
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d: %s", e.StatusCode, e.Message)
+}
+
+type retryTransport struct {
+	backoff Backoff
+	next    http.RoundTripper
+}
+
+// RoundTrip retries calls which are rate limited, whatever their method.
+// Calls which fail with a server error, or which do not reach Aiven, are
+// only retried when their method is idempotent, because Aiven may have made
+// the change before failing
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	ctx := req.Context()
+
+	for retry := 0; ; retry++ {
+		if retry > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				return nil, fmt.Errorf("cannot retry %s %s without GetBody", req.Method, req.URL)
+			}
+
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := next.RoundTrip(req)
+
+		if !t.shouldRetry(req, resp, err) {
+			return resp, err
+		}
+
+		class := StatusClass(err)
+		if resp != nil {
+			class = statusCodeClass(resp.StatusCode)
+		}
+
+		wait := t.backoff.interval(retry)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				wait = retryAfter
+			}
+		}
+
+		exhausted := retry >= t.backoff.MaxRetries
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			exhausted = true
+		}
+
+		if exhausted {
+			if resp == nil {
+				return nil, err
+			}
+			return nil, statusError(resp)
+		}
+
+		AivenAPIRetriesTotal.WithLabelValues(class).Inc()
+
+		if resp != nil {
+			// Drain the body so that the connection can be reused
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (t *retryTransport) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		return idempotent(req.Method)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode >= 500:
+		return idempotent(req.Method)
+	default:
+		return false
+	}
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date
+func parseRetryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+
+	return 0, false
+}
+
+func statusError(resp *http.Response) *StatusError {
+	defer resp.Body.Close()
+
+	message, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: maxErrorMessageSize})
+
+	return &StatusError{StatusCode: resp.StatusCode, Message: string(message)}
+}
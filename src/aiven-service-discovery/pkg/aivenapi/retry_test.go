@@ -0,0 +1,203 @@
+package aivenapi_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/jarcoal/httpmock"
+
+	aiven "github.com/aiven/aiven-go-client"
+
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/aivenapi"
+	h "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/testhelpers"
+)
+
+var _ = Describe("Retries", func() {
+	var (
+		client *aiven.Client
+
+		backoff = aivenapi.Backoff{
+			InitialInterval: 10 * time.Millisecond,
+			MaxInterval:     50 * time.Millisecond,
+			Exponent:        2,
+			MaxRetries:      2,
+		}
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		httpmock.Activate()
+
+		client, err = aivenapi.NewClient(token, "aivenapi-test", backoff)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		httpmock.DeactivateAndReset()
+	})
+
+	listServices := func(timeout time.Duration) error {
+		c, cancel := aivenapi.WithTimeout(context.Background(), *client, timeout)
+		defer cancel()
+
+		_, err := c.Services.List(project)
+		return err
+	}
+
+	respondWith := func(responses ...*http.Response) {
+		httpmock.RegisterResponder(
+			"GET", listServicesURL,
+			func(req *http.Request) (*http.Response, error) {
+				call := httpmock.GetTotalCallCount() - 1
+				if call < len(responses) {
+					return responses[call], nil
+				}
+
+				return httpmock.NewJsonResponse(200, map[string]interface{}{
+					"services": []interface{}{},
+				})
+			},
+		)
+	}
+
+	It("should retry server errors with backoff", func() {
+		retries := h.CurrentMetricValue(aivenapi.AivenAPIRetriesTotal.WithLabelValues("5xx"))
+
+		respondWith(
+			httpmock.NewStringResponse(502, ""),
+			httpmock.NewStringResponse(503, ""),
+		)
+
+		Expect(listServices(time.Minute)).To(Succeed())
+		Expect(httpmock.GetTotalCallCount()).To(Equal(3))
+
+		Expect(aivenapi.AivenAPIRetriesTotal.WithLabelValues("5xx")).To(
+			h.MetricIncrementedBy(retries, "==", 2),
+		)
+	})
+
+	It("should return the status once the retries are exhausted", func() {
+		respondWith(
+			httpmock.NewStringResponse(500, "first"),
+			httpmock.NewStringResponse(500, "second"),
+			httpmock.NewStringResponse(500, "third"),
+		)
+
+		err := listServices(time.Minute)
+		Expect(err).To(MatchError(ContainSubstring("500: third")))
+		Expect(aivenapi.StatusClass(err)).To(Equal("5xx"))
+
+		By("checking the Aiven client did not retry again itself")
+		Expect(httpmock.GetTotalCallCount()).To(Equal(3))
+	})
+
+	It("should not retry client errors other than rate limiting", func() {
+		respondWith(httpmock.NewStringResponse(403, ""))
+
+		err := listServices(time.Minute)
+		Expect(err).To(HaveOccurred())
+		Expect(aivenapi.StatusClass(err)).To(Equal("4xx"))
+		Expect(httpmock.GetTotalCallCount()).To(Equal(1))
+	})
+
+	It("should wait until the date in Retry-After", func() {
+		rateLimited := httpmock.NewStringResponse(429, "")
+		rateLimited.Header.Set(
+			"Retry-After",
+			time.Now().Add(2*time.Second).UTC().Format(http.TimeFormat),
+		)
+		respondWith(rateLimited)
+
+		start := time.Now()
+		Expect(listServices(time.Minute)).To(Succeed())
+
+		// HTTP dates only have a precision of seconds
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+		Expect(httpmock.GetTotalCallCount()).To(Equal(2))
+	})
+
+	It("should give up when Retry-After is beyond the deadline", func() {
+		rateLimited := httpmock.NewStringResponse(429, "")
+		rateLimited.Header.Set("Retry-After", "3600")
+		respondWith(rateLimited)
+
+		start := time.Now()
+		err := listServices(time.Minute)
+		Expect(err).To(HaveOccurred())
+		Expect(aivenapi.StatusClass(err)).To(Equal("4xx"))
+
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(httpmock.GetTotalCallCount()).To(Equal(1))
+	})
+
+	It("should retry calls which do not reach Aiven", func() {
+		httpmock.RegisterResponder(
+			"GET", listServicesURL,
+			func(req *http.Request) (*http.Response, error) {
+				if httpmock.GetTotalCallCount() == 1 {
+					return nil, fmt.Errorf("connection reset by peer")
+				}
+
+				return httpmock.NewJsonResponse(200, map[string]interface{}{
+					"services": []interface{}{},
+				})
+			},
+		)
+
+		Expect(listServices(time.Minute)).To(Succeed())
+		Expect(httpmock.GetTotalCallCount()).To(Equal(2))
+	})
+
+	It("should resend the body when retrying", func() {
+		bodies := make([]string, 0)
+
+		httpmock.RegisterResponder(
+			"POST", "https://api.aiven.io/v1/project/my-aiven-project/integration",
+			func(req *http.Request) (*http.Response, error) {
+				body := make([]byte, req.ContentLength)
+				req.Body.Read(body)
+				bodies = append(bodies, string(body))
+
+				if len(bodies) == 1 {
+					return httpmock.NewStringResponse(429, ""), nil
+				}
+
+				return httpmock.NewJsonResponse(200, map[string]interface{}{
+					"service_integration": aiven.ServiceIntegration{},
+				})
+			},
+		)
+
+		c, cancel := aivenapi.WithTimeout(context.Background(), *client, time.Minute)
+		defer cancel()
+
+		service := "a-service"
+		_, err := c.ServiceIntegrations.Create(project, aiven.CreateServiceIntegrationRequest{
+			SourceService:   &service,
+			IntegrationType: "prometheus",
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(bodies).To(HaveLen(2))
+		Expect(bodies[1]).To(Equal(bodies[0]))
+		Expect(bodies[1]).To(ContainSubstring("a-service"))
+	})
+
+	It("should classify failures by their HTTP status", func() {
+		Expect(aivenapi.StatusClass(aiven.Error{Status: 429})).To(Equal("4xx"))
+		Expect(aivenapi.StatusClass(aiven.Error{Status: 503})).To(Equal("5xx"))
+		Expect(aivenapi.StatusClass(&aivenapi.StatusError{StatusCode: 502})).To(Equal("5xx"))
+
+		By("classifying failures without a status")
+		Expect(aivenapi.StatusClass(fmt.Errorf("list: %w", context.DeadlineExceeded))).To(Equal("timeout"))
+		Expect(aivenapi.StatusClass(fmt.Errorf("list: %w", context.Canceled))).To(Equal("cancelled"))
+		Expect(aivenapi.StatusClass(errors.New("connection refused"))).To(Equal("other"))
+	})
+})
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+)
+
+type ProjectConfig struct {
+	Name                 string `json:"name"`
+	APIToken             string `json:"api_token"`
+	PrometheusEndpointID string `json:"prometheus_endpoint_id"`
+
+	// TargetPath is optional, when it is empty the targets for the project
+	// are written to the merged target path instead
+	TargetPath string `json:"target_path"`
+}
+
+// ServiceTypesConfig chooses which Aiven service types are integrated with
+// Prometheus. When Allow is empty, every type which supports the integration
+// is allowed. Types in Deny are never integrated
+type ServiceTypesConfig struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// ScrapeConfig is how Prometheus should scrape services of a type. Empty
+// fields use the defaults of the Aiven Prometheus integration
+type ScrapeConfig struct {
+	Port        int    `json:"port"`
+	Scheme      string `json:"scheme"`
+	MetricsPath string `json:"metrics_path"`
+}
+
+// ReconcileConfig chooses whether existing Prometheus integrations which
+// point at another endpoint are moved, and duplicates removed, and whether
+// the integrations with the endpoint of denied service types are removed.
+// When DryRun is true the changes are only logged and counted
+type ReconcileConfig struct {
+	Enabled      bool `json:"enabled"`
+	RemoveDenied bool `json:"remove_denied"`
+	DryRun       bool `json:"dry_run"`
+}
+
+// ServiceFilterConfig chooses which Aiven services with a Prometheus
+// integration are discovered. When ExcludeStates is not provided, services
+// which are powered off or rebuilding are not discovered. Empty name
+// patterns and service types match every service
+type ServiceFilterConfig struct {
+	ExcludeStates    []string `json:"exclude_states"`
+	IncludeNameRegex string   `json:"include_name_regex"`
+	ExcludeNameRegex string   `json:"exclude_name_regex"`
+	ServiceTypes     []string `json:"service_types"`
+}
+
+// DNSConfig is how the nodes of services are resolved. When Servers is
+// empty the nameservers in /etc/resolv.conf are used. Timeout is a
+// duration, such as 2s, for each query. Family is ipv4, ipv6 or both
+type DNSConfig struct {
+	Servers []string `json:"servers"`
+	Timeout string   `json:"timeout"`
+	Retries int      `json:"retries"`
+	Family  string   `json:"family"`
+}
+
+// TimeoutDuration is the parsed Timeout, or zero when it is not provided
+func (d DNSConfig) TimeoutDuration() (time.Duration, error) {
+	if d.Timeout == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(d.Timeout)
+}
+
+// LabelConfig adds a label to the targets of a service from a field of the
+// service, such as state or metadata.team
+type LabelConfig struct {
+	Label string `json:"label"`
+	Field string `json:"field"`
+}
+
+type Config struct {
+	Projects []ProjectConfig `json:"projects"`
+
+	MergedTargetPath string `json:"merged_target_path"`
+
+	// HTTPSD serves the targets over HTTP for Prometheus http_sd_config, in
+	// which case writing the targets to files is optional
+	HTTPSD bool `json:"http_sd"`
+
+	ServiceTypes ServiceTypesConfig `json:"service_types"`
+	Reconcile    ReconcileConfig    `json:"reconcile"`
+
+	ServiceFilter ServiceFilterConfig `json:"service_filter"`
+
+	// ScrapeConfigs are keyed by service type
+	ScrapeConfigs map[string]ScrapeConfig `json:"scrape_configs"`
+
+	Labels []LabelConfig `json:"labels"`
+
+	DNS DNSConfig `json:"dns"`
+}
+
+func LoadConfig(path string) (Config, error) {
+	var config Config
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(contents, &config)
+	if err != nil {
+		return config, err
+	}
+
+	return config, config.Validate()
+}
+
+func (c Config) Validate() error {
+	if len(c.Projects) == 0 {
+		return fmt.Errorf("Config invalid: projects must not be empty")
+	}
+
+	names := make(map[string]bool, len(c.Projects))
+
+	for index, project := range c.Projects {
+		if project.Name == "" {
+			return fmt.Errorf("Config invalid: projects[%d].name must be provided", index)
+		}
+
+		if names[project.Name] {
+			return fmt.Errorf("Config invalid: project %s is specified more than once", project.Name)
+		}
+		names[project.Name] = true
+
+		if project.APIToken == "" {
+			return fmt.Errorf("Config invalid: project %s must have an api_token", project.Name)
+		}
+
+		if project.PrometheusEndpointID == "" {
+			return fmt.Errorf("Config invalid: project %s must have a prometheus_endpoint_id", project.Name)
+		}
+
+		if project.TargetPath == "" && c.MergedTargetPath == "" && !c.HTTPSD {
+			return fmt.Errorf(
+				"Config invalid: project %s must have a target_path when merged_target_path is not provided",
+				project.Name,
+			)
+		}
+	}
+
+	for serviceType, scrapeConfig := range c.ScrapeConfigs {
+		if scrapeConfig.Port < 0 || scrapeConfig.Port > 65535 {
+			return fmt.Errorf("Config invalid: scrape_configs.%s.port must be between 1 and 65535, or 0 for the default", serviceType)
+		}
+
+		switch scrapeConfig.Scheme {
+		case "", "http", "https":
+		default:
+			return fmt.Errorf("Config invalid: scrape_configs.%s.scheme must be http or https", serviceType)
+		}
+	}
+
+	if _, err := regexp.Compile(c.ServiceFilter.IncludeNameRegex); err != nil {
+		return fmt.Errorf("Config invalid: service_filter.include_name_regex: %s", err)
+	}
+
+	if _, err := regexp.Compile(c.ServiceFilter.ExcludeNameRegex); err != nil {
+		return fmt.Errorf("Config invalid: service_filter.exclude_name_regex: %s", err)
+	}
+
+	if timeout, err := c.DNS.TimeoutDuration(); err != nil || timeout < 0 {
+		return fmt.Errorf("Config invalid: dns.timeout must be a positive duration")
+	}
+
+	if c.DNS.Retries < 0 {
+		return fmt.Errorf("Config invalid: dns.retries must not be negative")
+	}
+
+	switch c.DNS.Family {
+	case "", "ipv4", "ipv6", "both":
+	default:
+		return fmt.Errorf("Config invalid: dns.family must be ipv4, ipv6 or both")
+	}
+
+	for index, label := range c.Labels {
+		if label.Field == "" {
+			return fmt.Errorf("Config invalid: labels[%d].field must be provided", index)
+		}
+	}
+
+	return nil
+}
+
+// ProjectsByTargetPath groups the projects by the file to which their
+// targets should be written. Projects whose targets are only served over
+// HTTP are grouped under the empty path
+func (c Config) ProjectsByTargetPath() map[string][]ProjectConfig {
+	grouped := make(map[string][]ProjectConfig)
+
+	for _, project := range c.Projects {
+		targetPath := project.TargetPath
+		if targetPath == "" {
+			targetPath = c.MergedTargetPath
+		}
+
+		grouped[targetPath] = append(grouped[targetPath], project)
+	}
+
+	return grouped
+}
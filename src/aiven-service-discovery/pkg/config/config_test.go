@@ -0,0 +1,335 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/config"
+)
+
+var _ = Describe("Config", func() {
+	var (
+		path string
+	)
+
+	writeConfig := func(contents string) {
+		configFile, err := ioutil.TempFile("", "config")
+		Expect(err).NotTo(HaveOccurred())
+		path = configFile.Name()
+
+		_, err = configFile.WriteString(contents)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = configFile.Close()
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	AfterEach(func() {
+		if path != "" {
+			os.Remove(path)
+		}
+	})
+
+	Context("when the config is valid", func() {
+		It("should load the projects", func() {
+			writeConfig(`{
+				"merged_target_path": "/tmp/merged.json",
+				"projects": [{
+					"name": "a-project",
+					"api_token": "a-token",
+					"prometheus_endpoint_id": "an-endpoint"
+				}, {
+					"name": "another-project",
+					"api_token": "another-token",
+					"prometheus_endpoint_id": "another-endpoint",
+					"target_path": "/tmp/another.json"
+				}, {
+					"name": "a-third-project",
+					"api_token": "a-third-token",
+					"prometheus_endpoint_id": "a-third-endpoint"
+				}]
+			}`)
+
+			c, err := config.LoadConfig(path)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.Projects).To(HaveLen(3))
+			Expect(c.Projects[1]).To(Equal(config.ProjectConfig{
+				Name:                 "another-project",
+				APIToken:             "another-token",
+				PrometheusEndpointID: "another-endpoint",
+				TargetPath:           "/tmp/another.json",
+			}))
+
+			By("grouping the projects by target path")
+			grouped := c.ProjectsByTargetPath()
+			Expect(grouped).To(HaveLen(2))
+			Expect(grouped["/tmp/merged.json"]).To(HaveLen(2))
+			Expect(grouped["/tmp/merged.json"][0].Name).To(Equal("a-project"))
+			Expect(grouped["/tmp/merged.json"][1].Name).To(Equal("a-third-project"))
+			Expect(grouped["/tmp/another.json"]).To(HaveLen(1))
+			Expect(grouped["/tmp/another.json"][0].Name).To(Equal("another-project"))
+		})
+
+		It("should load the service types", func() {
+			writeConfig(`{
+				"merged_target_path": "/tmp/merged.json",
+				"projects": [{
+					"name": "a-project",
+					"api_token": "a-token",
+					"prometheus_endpoint_id": "an-endpoint"
+				}],
+				"service_types": {
+					"allow": ["pg", "mysql"],
+					"deny": ["mysql"]
+				},
+				"reconcile": {"enabled": true, "remove_denied": true, "dry_run": true},
+				"scrape_configs": {
+					"pg": {"port": 9274, "scheme": "http", "metrics_path": "/pg-metrics"}
+				}
+			}`)
+
+			c, err := config.LoadConfig(path)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.ServiceTypes).To(Equal(config.ServiceTypesConfig{
+				Allow: []string{"pg", "mysql"},
+				Deny:  []string{"mysql"},
+			}))
+			Expect(c.Reconcile).To(Equal(config.ReconcileConfig{
+				Enabled:      true,
+				RemoveDenied: true,
+				DryRun:       true,
+			}))
+			Expect(c.ScrapeConfigs).To(Equal(map[string]config.ScrapeConfig{
+				"pg": config.ScrapeConfig{Port: 9274, Scheme: "http", MetricsPath: "/pg-metrics"},
+			}))
+		})
+
+		It("should load the service filter", func() {
+			writeConfig(`{
+				"merged_target_path": "/tmp/merged.json",
+				"projects": [{
+					"name": "a-project",
+					"api_token": "a-token",
+					"prometheus_endpoint_id": "an-endpoint"
+				}],
+				"service_filter": {
+					"exclude_states": ["POWEROFF"],
+					"include_name_regex": "^tenant-",
+					"exclude_name_regex": "-test$",
+					"service_types": ["pg"]
+				}
+			}`)
+
+			c, err := config.LoadConfig(path)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.ServiceFilter).To(Equal(config.ServiceFilterConfig{
+				ExcludeStates:    []string{"POWEROFF"},
+				IncludeNameRegex: "^tenant-",
+				ExcludeNameRegex: "-test$",
+				ServiceTypes:     []string{"pg"},
+			}))
+		})
+
+		It("should load the labels", func() {
+			writeConfig(`{
+				"merged_target_path": "/tmp/merged.json",
+				"projects": [{
+					"name": "a-project",
+					"api_token": "a-token",
+					"prometheus_endpoint_id": "an-endpoint"
+				}],
+				"labels": [
+					{"field": "state"},
+					{"label": "team", "field": "metadata.team"}
+				],
+				"dns": {
+					"servers": ["10.0.0.2", "10.0.0.3:5353"],
+					"timeout": "500ms",
+					"retries": 2,
+					"family": "ipv4"
+				}
+			}`)
+
+			c, err := config.LoadConfig(path)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(c.Labels).To(Equal([]config.LabelConfig{
+				config.LabelConfig{Field: "state"},
+				config.LabelConfig{Label: "team", Field: "metadata.team"},
+			}))
+			Expect(c.DNS).To(Equal(config.DNSConfig{
+				Servers: []string{"10.0.0.2", "10.0.0.3:5353"},
+				Timeout: "500ms",
+				Retries: 2,
+				Family:  "ipv4",
+			}))
+			Expect(c.DNS.TimeoutDuration()).To(Equal(500 * time.Millisecond))
+		})
+	})
+
+	Context("when the config is invalid", func() {
+		It("should return an error when the file does not exist", func() {
+			_, err := config.LoadConfig("/path/does/not/exist")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return an error when the file is not JSON", func() {
+			writeConfig(`projects: []`)
+
+			_, err := config.LoadConfig(path)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should return an error when there are no projects", func() {
+			writeConfig(`{"projects": [], "merged_target_path": "/tmp/merged.json"}`)
+
+			_, err := config.LoadConfig(path)
+			Expect(err).To(MatchError(ContainSubstring("projects must not be empty")))
+		})
+
+		It("should return an error when a project is specified twice", func() {
+			writeConfig(`{
+				"merged_target_path": "/tmp/merged.json",
+				"projects": [{
+					"name": "a-project",
+					"api_token": "a-token",
+					"prometheus_endpoint_id": "an-endpoint"
+				}, {
+					"name": "a-project",
+					"api_token": "a-token",
+					"prometheus_endpoint_id": "an-endpoint"
+				}]
+			}`)
+
+			_, err := config.LoadConfig(path)
+			Expect(err).To(MatchError(ContainSubstring("more than once")))
+		})
+
+		It("should return an error when a project has nowhere to write targets", func() {
+			writeConfig(`{
+				"projects": [{
+					"name": "a-project",
+					"api_token": "a-token",
+					"prometheus_endpoint_id": "an-endpoint"
+				}]
+			}`)
+
+			_, err := config.LoadConfig(path)
+			Expect(err).To(MatchError(ContainSubstring("must have a target_path")))
+		})
+
+		It("should not return an error when targets are only served over HTTP", func() {
+			writeConfig(`{
+				"http_sd": true,
+				"projects": [{
+					"name": "a-project",
+					"api_token": "a-token",
+					"prometheus_endpoint_id": "an-endpoint"
+				}]
+			}`)
+
+			c, err := config.LoadConfig(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.ProjectsByTargetPath()).To(HaveKey(""))
+		})
+
+		It("should return an error when a project has no api token", func() {
+			writeConfig(`{
+				"merged_target_path": "/tmp/merged.json",
+				"projects": [{
+					"name": "a-project",
+					"prometheus_endpoint_id": "an-endpoint"
+				}]
+			}`)
+
+			_, err := config.LoadConfig(path)
+			Expect(err).To(MatchError(ContainSubstring("must have an api_token")))
+		})
+
+		It("should return an error when a scrape config has an invalid scheme", func() {
+			writeConfig(`{
+				"merged_target_path": "/tmp/merged.json",
+				"projects": [{
+					"name": "a-project",
+					"api_token": "a-token",
+					"prometheus_endpoint_id": "an-endpoint"
+				}],
+				"scrape_configs": {
+					"pg": {"scheme": "ftp"}
+				}
+			}`)
+
+			_, err := config.LoadConfig(path)
+			Expect(err).To(MatchError(ContainSubstring("scrape_configs.pg.scheme")))
+		})
+
+		It("should return an error when a scrape config has an invalid port", func() {
+			writeConfig(`{
+				"merged_target_path": "/tmp/merged.json",
+				"projects": [{
+					"name": "a-project",
+					"api_token": "a-token",
+					"prometheus_endpoint_id": "an-endpoint"
+				}],
+				"scrape_configs": {
+					"pg": {"port": 65536}
+				}
+			}`)
+
+			_, err := config.LoadConfig(path)
+			Expect(err).To(MatchError(ContainSubstring("scrape_configs.pg.port must be between 1 and 65535, or 0 for the default")))
+		})
+
+		It("should return an error when a service filter name pattern is invalid", func() {
+			writeConfig(`{
+				"merged_target_path": "/tmp/merged.json",
+				"projects": [{
+					"name": "a-project",
+					"api_token": "a-token",
+					"prometheus_endpoint_id": "an-endpoint"
+				}],
+				"service_filter": {"exclude_name_regex": "("}
+			}`)
+
+			_, err := config.LoadConfig(path)
+			Expect(err).To(MatchError(ContainSubstring("service_filter.exclude_name_regex")))
+		})
+
+		It("should return an error when the DNS family is invalid", func() {
+			writeConfig(`{
+				"merged_target_path": "/tmp/merged.json",
+				"projects": [{
+					"name": "a-project",
+					"api_token": "a-token",
+					"prometheus_endpoint_id": "an-endpoint"
+				}],
+				"dns": {"family": "ipv5"}
+			}`)
+
+			_, err := config.LoadConfig(path)
+			Expect(err).To(MatchError(ContainSubstring("dns.family")))
+		})
+
+		It("should return an error when a label has no field", func() {
+			writeConfig(`{
+				"merged_target_path": "/tmp/merged.json",
+				"projects": [{
+					"name": "a-project",
+					"api_token": "a-token",
+					"prometheus_endpoint_id": "an-endpoint"
+				}],
+				"labels": [{"label": "team"}]
+			}`)
+
+			_, err := config.LoadConfig(path)
+			Expect(err).To(MatchError(ContainSubstring("labels[0].field")))
+		})
+	})
+})
@@ -1,15 +1,24 @@
 package discoverer
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"code.cloudfoundry.org/lager"
 	aiven "github.com/aiven/aiven-go-client"
 
+	"github.com/alphagov/paas-observability-release/src/atomicfile"
+	"github.com/alphagov/paas-observability-release/src/health"
+
 	f "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/fetcher"
 	r "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/resolver"
 )
@@ -21,145 +30,444 @@ func init() {
 const (
 	defaultInterval         = 45 * time.Second
 	dnsDiscoveryConcurrency = 5
+
+	// resolveTimeout bounds resolving each node, whatever the timeout and
+	// retries of the resolver
+	resolveTimeout = 15 * time.Second
 )
 
 type Discoverer interface {
-	Start()
+	// LastSuccess is when targets were last discovered, and written when
+	// there is a target path, successfully
+	LastSuccess() time.Time
+
+	// Targets are the most recently discovered targets
+	Targets() []TargetGroup
+
+	// Start discovers whenever the services change, and every interval,
+	// until the context is done or Stop is called. Stop waits for in-flight
+	// DNS lookups to be cancelled, and is safe to call more than once
+	Start(context.Context)
 	Stop()
 
 	SetInterval(time.Duration)
 }
 
 type discoverer struct {
-	aivenProject string
-
 	targetPath string
 
-	fetcher  f.Fetcher
+	fetchers []f.Fetcher
 	resolver r.Resolver
 
+	serviceFilter ServiceFilter
+	scrapeConfigs ScrapeConfigs
+	labelMappings LabelMappings
+
+	lastKnownGood *lastKnownGood
+
 	logger lager.Logger
 
-	stop chan struct{}
-	wg   sync.WaitGroup
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 
+	// changed is notified by the fetchers when their services change, and
+	// the interval is a fallback which also picks up changes to DNS
+	changed  chan struct{}
 	interval time.Duration
+
+	lastSuccess health.Timestamp
+
+	targetsMutex sync.RWMutex
+	targets      []TargetGroup
+
+	// staleServices counts the stale target groups of the services which
+	// had them in the previous discovery, keyed by project then service. It
+	// is only used by the loop
+	staleServices map[string]map[string]int
+
+	// discoveredServices are the services of the previous discovery, keyed
+	// by project then service, so that the metrics of services which are no
+	// longer discovered are deleted. It is only used by the loop
+	discoveredServices map[string]map[string]bool
+
+	// previousTargets maps each target, qualified by its group, to its
+	// project, and is used to count the targets which changed. writtenHash
+	// is used to skip writing unchanged targets. Both are only used by the
+	// loop
+	previousTargets map[string]string
+	writtenHash     []byte
+}
+
+// projectService is a service along with the Aiven project it belongs to,
+// because a discoverer can discover services from many projects
+type projectService struct {
+	project string
+	service aiven.Service
 }
 
 func NewDiscoverer(
-	aivenProject string,
 	targetPath string,
 
-	fetcher f.Fetcher,
+	fetchers []f.Fetcher,
 	resolver r.Resolver,
 
+	serviceFilter ServiceFilter,
+	scrapeConfigs ScrapeConfigs,
+	labelMappings LabelMappings,
+
+	staleTargetGracePeriod time.Duration,
+
 	logger lager.Logger,
 ) (Discoverer, error) {
-	lsession := logger.Session("discoverer", lager.Data{"project": aivenProject})
+	projects := make([]string, 0)
+	for _, fetcher := range fetchers {
+		projects = append(projects, fetcher.Project())
+	}
+
+	lsession := logger.Session("discoverer", lager.Data{
+		"projects":    projects,
+		"target-path": targetPath,
+	})
+
+	err := labelMappings.Validate()
+	if err != nil {
+		lsession.Error("err-invalid-label-mappings", err)
+		return nil, err
+	}
 
 	d := discoverer{
-		aivenProject: aivenProject,
-		targetPath:   targetPath,
+		targetPath: targetPath,
 
-		fetcher:  fetcher,
+		fetchers: fetchers,
 		resolver: resolver,
 
-		logger: lsession,
+		serviceFilter: serviceFilter,
+		scrapeConfigs: scrapeConfigs,
+		labelMappings: labelMappings,
 
-		stop: make(chan struct{}),
+		lastKnownGood: newLastKnownGood(staleTargetGracePeriod),
+
+		logger: lsession,
 
+		changed:  make(chan struct{}, 1),
 		interval: defaultInterval,
 	}
 
+	for _, fetcher := range fetchers {
+		fetcher.Subscribe(d.changed)
+	}
+
 	return &d, nil
 }
 
 func (d *discoverer) goPerformDNSDiscovery(
-	services []aiven.Service,
+	ctx context.Context,
+	services []projectService,
 	wg *sync.WaitGroup,
-	results chan prometheusTargetConfig,
+	results chan TargetGroup,
 ) {
 	defer wg.Done()
 
 	lsession := d.logger.Session("go-perform-dns-discovery")
 
-	for _, service := range services {
+	for _, ps := range services {
+		if ctx.Err() != nil {
+			return
+		}
+
+		project, service := ps.project, ps.service
 
-		DiscovererDNSDiscoveriesTotal.Inc()
+		DiscovererDNSDiscoveriesTotal.WithLabelValues(project).Inc()
 
 		hostname, err := service.Hostname()
 		if err != nil {
 			lsession.Error(
-				"err-aiven-get-hostname", err, lager.Data{"service": service.Name},
+				"err-aiven-get-hostname", err,
+				lager.Data{"project": project, "service": service.Name},
 			)
 
-			DiscovererDNSDiscoveryErrorsTotal.Inc()
+			DiscovererDNSDiscoveryErrorsTotal.WithLabelValues(project).Inc()
 
 			continue
 		}
 
-		ips, err := d.resolver.Resolve(hostname)
-		if err != nil {
-			lsession.Error(
-				"err-resolve", err, lager.Data{"service": service.Name},
-			)
+		scrapeConfig := d.scrapeConfigs.For(service.Type)
+		mappedLabels := d.labelMappings.labelsFor(service)
+		port := strconv.Itoa(scrapeConfig.Port)
+
+		// The hosts of a service can resolve to the same IPs, such as the
+		// replica URI of pg which resolves to the standbys, so each IP is
+		// only a target of the first host which resolves to it
+		seenIPs := make(map[string]bool)
+
+		for _, node := range serviceNodes(service) {
+			key := project + "/" + service.Name + "/" + node.hostname
+			stale := ""
+
+			resolveCtx, cancel := context.WithTimeout(ctx, resolveTimeout)
+			ips, err := d.resolver.Resolve(resolveCtx, node.hostname)
+			cancel()
+
+			if err == nil {
+				d.lastKnownGood.remember(key, ips)
+			} else {
+				lsession.Error(
+					"err-resolve", err,
+					lager.Data{
+						"project": project,
+						"service": service.Name,
+						"node":    node.hostname,
+					},
+				)
+
+				DiscovererDNSDiscoveryErrorsTotal.WithLabelValues(project).Inc()
+				DiscovererServiceResolveErrorsTotal.WithLabelValues(project, service.Name).Inc()
+
+				var ok bool
+				ips, ok = d.lastKnownGood.recall(key)
+				if !ok {
+					continue
+				}
+
+				lsession.Info("use-last-known-good", lager.Data{
+					"project": project,
+					"service": service.Name,
+					"node":    node.hostname,
+					"ips":     ips,
+				})
+
+				stale = "true"
+			}
 
-			DiscovererDNSDiscoveryErrorsTotal.Inc()
+			targets := make([]string, 0, len(ips))
+			for _, ip := range ips {
+				if seenIPs[ip.String()] {
+					continue
+				}
+				seenIPs[ip.String()] = true
+
+				targets = append(
+					targets,
+					net.JoinHostPort(ip.String(), port),
+				)
+			}
 
-			continue
-		}
+			// A host with no IPs, or only IPs of other hosts, has nothing to
+			// scrape, and an empty group would only add noise
+			if len(targets) == 0 {
+				continue
+			}
 
-		results <- prometheusTargetConfig{
-			Labels: prometheusTargetConfigLabels{
-				ServiceName: service.Name,
-				ServiceType: service.Type,
-				Hostname:    hostname,
-				Plan:        service.Plan,
-				Cloud:       service.CloudName,
-				NodeCount:   fmt.Sprintf("%d", service.NodeCount),
-			},
-			Targets: ips,
+			results <- TargetGroup{
+				Labels: TargetGroupLabels{
+					Project:     project,
+					ServiceName: service.Name,
+					ServiceType: service.Type,
+					Hostname:    hostname,
+					Plan:        service.Plan,
+					Cloud:       service.CloudName,
+					NodeCount:   fmt.Sprintf("%d", service.NodeCount),
+					NodeName:    node.hostname,
+					NodeRole:    node.role,
+					Stale:       stale,
+					Scheme:      scrapeConfig.Scheme,
+					MetricsPath: scrapeConfig.MetricsPath,
+					Mapped:      mappedLabels,
+				},
+				Targets: targets,
+			}
 		}
 	}
 }
 
-func (d *discoverer) performDNSDiscovery(services []aiven.Service) []prometheusTargetConfig {
+func (d *discoverer) performDNSDiscovery(ctx context.Context, services []projectService) []TargetGroup {
 	lsession := d.logger.Session("perform-dns-discovery")
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	work := make(map[int][]aiven.Service, 0)
+	work := make(map[int][]projectService, 0)
 	for index, service := range services {
 		targetQueue := index % dnsDiscoveryConcurrency
 		work[targetQueue] = append(work[targetQueue], service)
 	}
 
 	var wg sync.WaitGroup
-	results := make(chan prometheusTargetConfig, len(services))
+	results := make(chan TargetGroup, len(services))
 
 	for _, queue := range work {
 		wg.Add(1)
-		go d.goPerformDNSDiscovery(queue, &wg, results)
+		go d.goPerformDNSDiscovery(ctx, queue, &wg, results)
 	}
 
-	wg.Wait()
-	close(results)
+	// Each service can have many nodes, so there can be more results than
+	// services, and the results must be read while discovery is running
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
 
-	targets := make([]prometheusTargetConfig, 0)
+	targets := make([]TargetGroup, 0)
 	for target := range results {
 		targets = append(targets, target)
 	}
 
+	sortTargetGroups(targets)
+
+	d.lastKnownGood.prune()
+
+	return targets
+}
+
+// recordTargets sets the target metrics of each project and the stale
+// target metrics of each service, and counts the targets added and removed
+// since the previous discovery
+func (d *discoverer) recordTargets(targets []TargetGroup) {
+	groupsByProject := make(map[string]int)
+	targetsByProject := make(map[string]int)
+	current := make(map[string]string)
+
+	for _, group := range targets {
+		project := group.Labels.Project
+
+		groupsByProject[project]++
+		targetsByProject[project] += len(group.Targets)
+
+		for _, target := range group.Targets {
+			current[targetGroupKey(group)+"/"+target] = project
+		}
+	}
+
+	for _, fetcher := range d.fetchers {
+		project := fetcher.Project()
+
+		DiscovererTargetGroups.WithLabelValues(project).Set(float64(groupsByProject[project]))
+		DiscovererTargets.WithLabelValues(project).Set(float64(targetsByProject[project]))
+	}
+
+	staleServices := make(map[string]map[string]int)
+	for _, group := range targets {
+		if group.Labels.Stale == "" {
+			continue
+		}
+
+		project, service := group.Labels.Project, group.Labels.ServiceName
+		if staleServices[project] == nil {
+			staleServices[project] = make(map[string]int)
+		}
+		staleServices[project][service]++
+	}
+
+	// Services only have a stale metric while they have stale targets, so
+	// that services which are deleted do not keep their metrics
+	for project, services := range d.staleServices {
+		for service := range services {
+			if _, ok := staleServices[project][service]; !ok {
+				DiscovererStaleTargetGroups.DeleteLabelValues(project, service)
+			}
+		}
+	}
+	for project, services := range staleServices {
+		for service, count := range services {
+			DiscovererStaleTargetGroups.WithLabelValues(project, service).Set(float64(count))
+		}
+	}
+
+	d.staleServices = staleServices
+
+	for key, project := range current {
+		if _, ok := d.previousTargets[key]; !ok {
+			DiscovererTargetsAddedTotal.WithLabelValues(project).Inc()
+		}
+	}
+
+	for key, project := range d.previousTargets {
+		if _, ok := current[key]; !ok {
+			DiscovererTargetsRemovedTotal.WithLabelValues(project).Inc()
+		}
+	}
+
+	d.previousTargets = current
+}
+
+// forgetServices deletes the per service metrics of the services which were
+// discovered previously but are no longer, such as when they are deleted,
+// so that the number of series does not keep growing. The services of held
+// projects are kept, as they are not known
+func (d *discoverer) forgetServices(services []projectService, held map[string]bool) {
+	discovered := make(map[string]map[string]bool)
+	for _, ps := range services {
+		if discovered[ps.project] == nil {
+			discovered[ps.project] = make(map[string]bool)
+		}
+		discovered[ps.project][ps.service.Name] = true
+	}
+
+	for project, previous := range d.discoveredServices {
+		if held[project] {
+			discovered[project] = previous
+			continue
+		}
+
+		for service := range previous {
+			if discovered[project][service] {
+				continue
+			}
+
+			DiscovererServiceResolveErrorsTotal.DeleteLabelValues(project, service)
+			DiscovererStaleTargetGroups.DeleteLabelValues(project, service)
+		}
+	}
+
+	d.discoveredServices = discovered
+}
+
+// heldTargetGroups are the previous target groups of the held projects.
+// Before the first discovery they are read from the target file, which was
+// written before a restart
+func (d *discoverer) heldTargetGroups(held map[string]bool) []TargetGroup {
+	previous := d.Targets()
+	if previous == nil && d.targetPath != "" {
+		previous = d.readTargets()
+	}
+
+	groups := make([]TargetGroup, 0)
+	for _, group := range previous {
+		if held[group.Labels.Project] {
+			groups = append(groups, group)
+		}
+	}
+
+	return groups
+}
+
+// readTargets reads the target groups which were last written, or none when
+// they cannot be read, such as before they are first written
+func (d *discoverer) readTargets() []TargetGroup {
+	lsession := d.logger.Session("read-targets")
+
+	contents, err := ioutil.ReadFile(d.targetPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			lsession.Error("err-read-targets", err, lager.Data{"target-path": d.targetPath})
+		}
+		return nil
+	}
+
+	var targets []TargetGroup
+	err = json.Unmarshal(contents, &targets)
+	if err != nil {
+		lsession.Error("err-unmarshal-json-targets", err, lager.Data{"target-path": d.targetPath})
+		return nil
+	}
+
 	return targets
 }
 
-func (d *discoverer) writeTargets(targets []prometheusTargetConfig) {
+func (d *discoverer) writeTargets(targets []TargetGroup) {
 	lsession := d.logger.Session("write-targets")
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	DiscovererWriteTargetsTotal.Inc()
-
 	targetsAsJSON, err := json.Marshal(targets)
 
 	if err != nil {
@@ -173,7 +481,20 @@ func (d *discoverer) writeTargets(targets []prometheusTargetConfig) {
 		return
 	}
 
-	err = ioutil.WriteFile(d.targetPath, targetsAsJSON, 0644)
+	hash := sha256.Sum256(targetsAsJSON)
+	if bytes.Equal(hash[:], d.writtenHash) {
+		lsession.Info("skip-unchanged-targets")
+
+		DiscovererWriteTargetsSkippedTotal.Inc()
+
+		d.lastSuccess.Succeeded()
+
+		return
+	}
+
+	DiscovererWriteTargetsTotal.Inc()
+
+	err = atomicfile.WriteFile(d.targetPath, targetsAsJSON, 0644)
 	if err != nil {
 		lsession.Error(
 			"err-write-json-targets",
@@ -184,58 +505,133 @@ func (d *discoverer) writeTargets(targets []prometheusTargetConfig) {
 
 		return
 	}
+
+	d.writtenHash = hash[:]
+	d.lastSuccess.Succeeded()
 }
 
-func (d *discoverer) discoverAndWrite() {
+func (d *discoverer) discoverAndWrite(ctx context.Context) {
 	lsession := d.logger.Session("discover")
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	services := d.fetcher.Services()
+	// Until a fetcher has succeeded the services of its project are not
+	// known, so the project is held back with the target groups it had,
+	// rather than having its targets dropped. The other projects are still
+	// discovered, so that one failing project does not block them
+	ready := make([]f.Fetcher, 0, len(d.fetchers))
+	held := make(map[string]bool)
+	for _, fetcher := range d.fetchers {
+		if fetcher.LastSuccess().IsZero() {
+			lsession.Info("hold-fetcher-not-ready", lager.Data{
+				"project": fetcher.Project(),
+			})
+			held[fetcher.Project()] = true
+			continue
+		}
+
+		ready = append(ready, fetcher)
+	}
+
+	if len(ready) == 0 {
+		return
+	}
 
-	servicesWithPrometheus := make([]aiven.Service, 0)
-	for _, service := range services {
-		hasPrometheus := false
-		for _, integration := range service.Integrations {
-			if integration.IntegrationType == "prometheus" {
-				hasPrometheus = true
+	servicesWithPrometheus := make([]projectService, 0)
+	for _, fetcher := range ready {
+		for _, service := range fetcher.Services() {
+			hasPrometheus := false
+			for _, integration := range service.Integrations {
+				if integration.IntegrationType == "prometheus" {
+					hasPrometheus = true
+				}
 			}
-		}
 
-		if hasPrometheus {
-			servicesWithPrometheus = append(servicesWithPrometheus, service)
+			if !hasPrometheus {
+				continue
+			}
+
+			discover, reason := d.serviceFilter.Discover(service)
+			if !discover {
+				lsession.Info("filter-service", lager.Data{
+					"project":       fetcher.Project(),
+					"service":       service.Name,
+					"service-type":  service.Type,
+					"service-state": service.State,
+					"reason":        reason,
+				})
+
+				DiscovererServicesFilteredTotal.WithLabelValues(reason).Inc()
+
+				continue
+			}
+
+			servicesWithPrometheus = append(
+				servicesWithPrometheus,
+				projectService{project: fetcher.Project(), service: service},
+			)
 		}
 	}
 
-	targets := d.performDNSDiscovery(servicesWithPrometheus)
+	targets := d.performDNSDiscovery(ctx, servicesWithPrometheus)
+
+	// When cancelled the targets are incomplete, so they are not written
+	if ctx.Err() != nil {
+		lsession.Info("cancelled")
+		return
+	}
+
+	if len(held) > 0 {
+		targets = append(targets, d.heldTargetGroups(held)...)
+		orderTargetGroups(targets)
+	}
+
 	lsession.Info("targets", lager.Data{"targets": targets})
+
+	d.recordTargets(targets)
+	d.forgetServices(servicesWithPrometheus, held)
+
+	d.targetsMutex.Lock()
+	d.targets = targets
+	d.targetsMutex.Unlock()
+
+	// Writing targets to a file is optional when they are served over HTTP
+	if d.targetPath == "" {
+		d.lastSuccess.Succeeded()
+		return
+	}
+
 	d.writeTargets(targets)
 }
 
-func (d *discoverer) loop() {
+func (d *discoverer) loop(ctx context.Context) {
 	lsession := d.logger.Session("loop")
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	d.wg.Add(1)
+	defer d.wg.Done()
 
 	for {
 		select {
 		case <-time.After(d.interval):
-			d.discoverAndWrite()
-		case <-d.stop:
-			d.wg.Done()
+			d.discoverAndWrite(ctx)
+		case <-d.changed:
+			d.discoverAndWrite(ctx)
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (d *discoverer) Start() {
+func (d *discoverer) Start(ctx context.Context) {
 	lsession := d.logger.Session("start")
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	go d.loop()
+	ctx, d.cancel = context.WithCancel(ctx)
+
+	d.wg.Add(1)
+	go d.loop(ctx)
 }
 
 func (d *discoverer) Stop() {
@@ -243,10 +639,23 @@ func (d *discoverer) Stop() {
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	close(d.stop)
+	if d.cancel != nil {
+		d.cancel()
+	}
 	d.wg.Wait()
 }
 
+func (d *discoverer) LastSuccess() time.Time {
+	return d.lastSuccess.LastSuccess()
+}
+
+func (d *discoverer) Targets() []TargetGroup {
+	d.targetsMutex.RLock()
+	defer d.targetsMutex.RUnlock()
+
+	return d.targets
+}
+
 func (d *discoverer) SetInterval(interval time.Duration) {
 	d.interval = interval
 }
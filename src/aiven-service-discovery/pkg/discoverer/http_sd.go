@@ -0,0 +1,76 @@
+package discoverer
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// NewHTTPSDHandler serves the targets of the discoverers in the Prometheus
+// http_sd_config format. The targets can be limited to a single project with
+// the project query parameter.
+//
+// Until every discoverer has succeeded the targets are incomplete, so the
+// response is 503 Service Unavailable, and Prometheus keeps the targets it
+// already has rather than replacing them with none.
+//
+// Responses have an ETag, so that Prometheus polling with If-None-Match gets
+// a 304 Not Modified, without a body, while the targets are unchanged
+func NewHTTPSDHandler(discoverers []Discoverer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, discoverer := range discoverers {
+			if discoverer.LastSuccess().IsZero() {
+				http.Error(w, "targets have not been discovered yet", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		project := req.URL.Query().Get("project")
+
+		targets := make([]TargetGroup, 0)
+		for _, discoverer := range discoverers {
+			for _, target := range discoverer.Targets() {
+				if project == "" || target.Labels.Project == project {
+					targets = append(targets, target)
+				}
+			}
+		}
+
+		// The groups of many discoverers are sorted together to keep the
+		// response, and so the ETag, the same while they are unchanged. The
+		// targets of each group are shared with the discoverers, which have
+		// already sorted them
+		orderTargetGroups(targets)
+
+		body, err := json.Marshal(targets)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+
+		if etagMatches(req.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	})
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package discoverer_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"code.cloudfoundry.org/lager"
+	aiven "github.com/aiven/aiven-go-client"
+
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/discoverer"
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/fetcher"
+	fetcherfakes "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/fetcher/fakes"
+	resolverfakes "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/resolver/fakes"
+)
+
+var _ = Describe("HTTPSDHandler", func() {
+	var (
+		d discoverer.Discoverer
+		f *fetcherfakes.FakeFetcher
+		r *resolverfakes.FakeResolver
+
+		handler http.Handler
+	)
+
+	get := func(path string, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		logger := lager.NewLogger("http-sd-test")
+		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
+
+		f = fetcherfakes.NewFakeFetcher(project)
+		r = resolverfakes.NewFakeResolver()
+
+		By("not writing the targets to a file")
+		d, err = discoverer.NewDiscoverer(
+			"",
+			[]fetcher.Fetcher{f}, r,
+			discoverer.ServiceFilter{},
+			discoverer.ScrapeConfigs{},
+			discoverer.LabelMappings{},
+			0,
+			logger,
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		d.SetInterval(100 * time.Millisecond) // We want fast tests
+
+		handler = discoverer.NewHTTPSDHandler([]discoverer.Discoverer{d})
+	})
+
+	AfterEach(func() {
+		d.Stop()
+	})
+
+	It("should serve the discovered targets", func() {
+		By("being unavailable before discovery")
+		resp := get("/http_sd", "")
+		Expect(resp.Code).To(Equal(http.StatusServiceUnavailable))
+
+		f.ShouldReturn([]aiven.Service{
+			aiven.Service{
+				Name:      "a-service",
+				Type:      "elasticsearch",
+				Plan:      "tiny-6.x",
+				CloudName: "aws-eu-west-1",
+				NodeCount: 1,
+				URIParams: map[string]string{"host": "an-instance.aivencloud.com"},
+				Integrations: []*aiven.ServiceIntegration{
+					&aiven.ServiceIntegration{IntegrationType: "prometheus"},
+				},
+			},
+		})
+		r.ShouldReturnIPs([]net.IP{net.IPv4(1, 2, 3, 4)})
+
+		d.Start(context.Background())
+
+		Eventually(d.LastSuccess, evTimeout, evInterval).ShouldNot(BeZero())
+
+		resp = get("/http_sd", "")
+		Expect(resp.Code).To(Equal(http.StatusOK))
+		Expect(resp.Header().Get("Content-Type")).To(Equal("application/json"))
+		Expect(resp.Body.String()).To(MatchJSON(`[{
+			"targets": ["1.2.3.4:9273"],
+			"labels": {
+				"aiven_project": "my-aiven-project",
+				"aiven_service_name": "a-service",
+				"aiven_service_type": "elasticsearch",
+				"aiven_hostname": "an-instance.aivencloud.com",
+				"aiven_plan": "tiny-6.x",
+				"aiven_cloud": "aws-eu-west-1",
+				"aiven_node_count": "1",
+				"aiven_node_name": "an-instance.aivencloud.com",
+				"__scheme__": "https",
+				"__metrics_path__": "/metrics"
+			}
+		}]`))
+
+		etag := resp.Header().Get("ETag")
+		Expect(etag).NotTo(BeEmpty())
+
+		By("not serving the targets again while they are unchanged")
+		resp = get("/http_sd", etag)
+		Expect(resp.Code).To(Equal(http.StatusNotModified))
+		Expect(resp.Body.Len()).To(Equal(0))
+
+		By("filtering the targets by project")
+		resp = get("/http_sd?project=another-project", "")
+		Expect(resp.Code).To(Equal(http.StatusOK))
+		Expect(resp.Body.String()).To(MatchJSON(`[]`))
+
+		By("serving the targets again once they have changed")
+		r.ShouldReturnIPs([]net.IP{net.IPv4(4, 3, 2, 1)})
+
+		Eventually(func() int {
+			return get("/http_sd", etag).Code
+		}, evTimeout, evInterval).Should(Equal(http.StatusOK))
+	})
+
+	It("should not modify the targets of the discoverers", func() {
+		targets := []discoverer.TargetGroup{
+			discoverer.TargetGroup{
+				Targets: []string{"5.6.7.8:9273", "1.2.3.4:9273"},
+				Labels:  discoverer.TargetGroupLabels{Project: project, ServiceName: "b-service"},
+			},
+			discoverer.TargetGroup{
+				Targets: []string{"4.3.2.1:9273"},
+				Labels:  discoverer.TargetGroupLabels{Project: project, ServiceName: "a-service"},
+			},
+		}
+		handler = discoverer.NewHTTPSDHandler([]discoverer.Discoverer{
+			&staticDiscoverer{targets: targets},
+		})
+
+		resp := get("/http_sd", "")
+		Expect(resp.Code).To(Equal(http.StatusOK))
+
+		By("ordering the groups of the response")
+		var served []discoverer.TargetGroup
+		Expect(json.Unmarshal(resp.Body.Bytes(), &served)).To(Succeed())
+		Expect(served).To(HaveLen(2))
+		Expect(served[0].Labels.ServiceName).To(Equal("a-service"))
+
+		By("leaving the targets of the discoverer as they were")
+		Expect(targets[0].Labels.ServiceName).To(Equal("b-service"))
+		Expect(targets[0].Targets).To(Equal([]string{"5.6.7.8:9273", "1.2.3.4:9273"}))
+	})
+})
+
+// staticDiscoverer has discovered a fixed set of targets
+type staticDiscoverer struct {
+	targets []discoverer.TargetGroup
+}
+
+func (s *staticDiscoverer) LastSuccess() time.Time            { return time.Now() }
+func (s *staticDiscoverer) Targets() []discoverer.TargetGroup { return s.targets }
+func (s *staticDiscoverer) Start(_ context.Context)           {}
+func (s *staticDiscoverer) Stop()                             {}
+func (s *staticDiscoverer) SetInterval(_ time.Duration)       {}
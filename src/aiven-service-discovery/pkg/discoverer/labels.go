@@ -0,0 +1,192 @@
+package discoverer
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	aiven "github.com/aiven/aiven-go-client"
+)
+
+const (
+	fieldState             = "state"
+	fieldProjectVPCID      = "project_vpc_id"
+	fieldGroupList         = "group_list"
+	fieldMaintenanceWindow = "maintenance_window"
+	fieldMetadataPrefix    = "metadata."
+	fieldMetadataAll       = "metadata.*"
+)
+
+var (
+	invalidLabelNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+	builtinLabels = builtinLabelNames()
+)
+
+// LabelMapping adds a label to the targets of a service from a field of the
+// service. Field is one of state, project_vpc_id, group_list,
+// maintenance_window, metadata.<key> for a key of the metadata, where nested
+// keys are separated by dots, or metadata.* for every top level key of the
+// metadata.
+//
+// When Label is empty it is aiven_ followed by the field. For metadata.*,
+// Label is a prefix for the keys of the metadata, by default aiven_metadata_
+type LabelMapping struct {
+	Label string
+	Field string
+}
+
+type LabelMappings []LabelMapping
+
+// SanitiseLabelName replaces any characters which are not valid in a
+// Prometheus label name with underscores
+func SanitiseLabelName(name string) string {
+	name = invalidLabelNameChars.ReplaceAllString(name, "_")
+
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+
+	return name
+}
+
+func (m LabelMappings) Validate() error {
+	for _, mapping := range m {
+		switch {
+		case mapping.Field == fieldState,
+			mapping.Field == fieldProjectVPCID,
+			mapping.Field == fieldGroupList,
+			mapping.Field == fieldMaintenanceWindow,
+			mapping.Field == fieldMetadataAll:
+		case strings.HasPrefix(mapping.Field, fieldMetadataPrefix) &&
+			len(mapping.Field) > len(fieldMetadataPrefix):
+		default:
+			return fmt.Errorf("Label mapping has unknown field %q", mapping.Field)
+		}
+
+		label := mapping.label()
+		if strings.HasPrefix(label, "__") {
+			return fmt.Errorf("Label mapping for %s must not use reserved label %s", mapping.Field, label)
+		}
+		if builtinLabels[label] {
+			return fmt.Errorf("Label mapping for %s must not replace label %s", mapping.Field, label)
+		}
+	}
+
+	return nil
+}
+
+func (m LabelMapping) label() string {
+	if m.Label != "" {
+		return SanitiseLabelName(m.Label)
+	}
+
+	if m.Field == fieldMetadataAll {
+		return "aiven_metadata_"
+	}
+
+	return SanitiseLabelName("aiven_" + m.Field)
+}
+
+// labelsFor returns the mapped labels of a service. Fields which are missing
+// or empty do not produce a label
+func (m LabelMappings) labelsFor(service aiven.Service) map[string]string {
+	labels := make(map[string]string)
+
+	for _, mapping := range m {
+		if mapping.Field == fieldMetadataAll {
+			metadata, ok := service.Metadata.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			for key, value := range metadata {
+				label := SanitiseLabelName(mapping.label() + key)
+				if builtinLabels[label] {
+					continue
+				}
+
+				if v := labelValue(value); v != "" {
+					labels[label] = v
+				}
+			}
+
+			continue
+		}
+
+		var value string
+
+		switch mapping.Field {
+		case fieldState:
+			value = service.State
+		case fieldProjectVPCID:
+			if service.ProjectVPCID != nil {
+				value = *service.ProjectVPCID
+			}
+		case fieldGroupList:
+			groups := append([]string{}, service.GroupList...)
+			sort.Strings(groups)
+			value = strings.Join(groups, ",")
+		case fieldMaintenanceWindow:
+			window := service.MaintenanceWindow
+			value = strings.TrimSpace(window.DayOfWeek + " " + window.TimeOfDay)
+		default:
+			path := strings.Split(strings.TrimPrefix(mapping.Field, fieldMetadataPrefix), ".")
+			value = labelValue(lookup(service.Metadata, path))
+		}
+
+		if value != "" {
+			labels[mapping.label()] = value
+		}
+	}
+
+	return labels
+}
+
+func lookup(value interface{}, path []string) interface{} {
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+func labelValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(encoded)
+	}
+}
+
+func builtinLabelNames() map[string]bool {
+	names := make(map[string]bool)
+
+	t := reflect.TypeOf(TargetGroupLabels{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,47 @@
+package discoverer_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/discoverer"
+)
+
+var _ = Describe("LabelMappings", func() {
+	It("should sanitise label names", func() {
+		Expect(discoverer.SanitiseLabelName("team")).To(Equal("team"))
+		Expect(discoverer.SanitiseLabelName("cost-centre.code")).To(Equal("cost_centre_code"))
+		Expect(discoverer.SanitiseLabelName("1st-line")).To(Equal("_1st_line"))
+	})
+
+	It("should accept known fields", func() {
+		Expect(discoverer.LabelMappings{
+			{Field: "state"},
+			{Field: "project_vpc_id"},
+			{Field: "group_list"},
+			{Field: "maintenance_window"},
+			{Label: "team", Field: "metadata.owner.team"},
+			{Field: "metadata.*"},
+		}.Validate()).To(Succeed())
+	})
+
+	It("should reject unknown fields", func() {
+		Expect(discoverer.LabelMappings{
+			{Field: "not-a-field"},
+		}.Validate()).To(MatchError(ContainSubstring("unknown field")))
+
+		Expect(discoverer.LabelMappings{
+			{Field: "metadata."},
+		}.Validate()).To(MatchError(ContainSubstring("unknown field")))
+	})
+
+	It("should reject labels which would replace other labels", func() {
+		Expect(discoverer.LabelMappings{
+			{Label: "aiven_project", Field: "state"},
+		}.Validate()).To(MatchError(ContainSubstring("must not replace label aiven_project")))
+
+		Expect(discoverer.LabelMappings{
+			{Label: "__address__", Field: "state"},
+		}.Validate()).To(MatchError(ContainSubstring("must not use reserved label")))
+	})
+})
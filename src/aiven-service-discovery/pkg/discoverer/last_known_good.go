@@ -0,0 +1,67 @@
+package discoverer
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// lastKnownGood remembers the IPs to which the nodes of services last
+// resolved, so that a failure to resolve does not remove their targets
+// until the grace period has passed. A zero grace period disables it
+type lastKnownGood struct {
+	gracePeriod time.Duration
+
+	mutex       sync.Mutex
+	resolutions map[string]resolution
+}
+
+type resolution struct {
+	ips        []net.IP
+	resolvedAt time.Time
+}
+
+func newLastKnownGood(gracePeriod time.Duration) *lastKnownGood {
+	return &lastKnownGood{
+		gracePeriod: gracePeriod,
+		resolutions: make(map[string]resolution),
+	}
+}
+
+func (c *lastKnownGood) remember(key string, ips []net.IP) {
+	if c.gracePeriod <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.resolutions[key] = resolution{ips: ips, resolvedAt: time.Now()}
+}
+
+// recall returns the IPs remembered for the key, when they were resolved
+// within the grace period
+func (c *lastKnownGood) recall(key string) ([]net.IP, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	r, ok := c.resolutions[key]
+	if !ok || time.Since(r.resolvedAt) > c.gracePeriod {
+		return nil, false
+	}
+
+	return r.ips, true
+}
+
+// prune forgets the IPs which were resolved before the grace period, such as
+// those of services which no longer exist
+func (c *lastKnownGood) prune() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, r := range c.resolutions {
+		if time.Since(r.resolvedAt) > c.gracePeriod {
+			delete(c.resolutions, key)
+		}
+	}
+}
@@ -15,21 +15,71 @@ var (
 		Help: "Counter of total number of target file writes",
 	})
 
-	DiscovererDNSDiscoveryErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	DiscovererWriteTargetsSkippedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "discoverer_write_targets_skipped_total",
+		Help: "Counter of total number of target file writes skipped because the targets were unchanged",
+	})
+
+	DiscovererTargetGroups = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "discoverer_target_groups",
+		Help: "Gauge of the number of target groups, one for each node of a service, most recently discovered",
+	}, []string{"project"})
+
+	DiscovererTargets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "discoverer_targets",
+		Help: "Gauge of the number of targets most recently discovered",
+	}, []string{"project"})
+
+	DiscovererTargetsAddedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "discoverer_targets_added_total",
+		Help: "Counter of total number of targets which were discovered and were not in the previous discovery",
+	}, []string{"project"})
+
+	DiscovererTargetsRemovedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "discoverer_targets_removed_total",
+		Help: "Counter of total number of targets which were in the previous discovery and were not discovered",
+	}, []string{"project"})
+
+	DiscovererDNSDiscoveryErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "discoverer_dns_discovery_errors_total",
 		Help: "Counter of total number of DNS discovery errors",
-	})
+	}, []string{"project"})
 
-	DiscovererDNSDiscoveriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	DiscovererDNSDiscoveriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "discoverer_dns_discoveries_total",
 		Help: "Counter of total number of DNS discoveries",
-	})
+	}, []string{"project"})
+
+	DiscovererServiceResolveErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "discoverer_service_resolve_errors_total",
+		Help: "Counter of total number of failures to resolve the nodes of a service",
+	}, []string{"project", "service"})
+
+	DiscovererStaleTargetGroups = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "discoverer_stale_target_groups",
+		Help: "Gauge of the number of target groups of a service which use the IPs to which its nodes last resolved",
+	}, []string{"project", "service"})
+
+	DiscovererServicesFilteredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "discoverer_services_filtered_total",
+		Help: "Counter of total number of services with a Prometheus integration which were not discovered",
+	}, []string{"reason"})
 )
 
 func initMetrics() {
 	prometheus.MustRegister(DiscovererWriteTargetsErrorsTotal)
 	prometheus.MustRegister(DiscovererWriteTargetsTotal)
+	prometheus.MustRegister(DiscovererWriteTargetsSkippedTotal)
+
+	prometheus.MustRegister(DiscovererTargetGroups)
+	prometheus.MustRegister(DiscovererTargets)
+	prometheus.MustRegister(DiscovererTargetsAddedTotal)
+	prometheus.MustRegister(DiscovererTargetsRemovedTotal)
 
 	prometheus.MustRegister(DiscovererDNSDiscoveryErrorsTotal)
 	prometheus.MustRegister(DiscovererDNSDiscoveriesTotal)
+	prometheus.MustRegister(DiscovererServiceResolveErrorsTotal)
+	prometheus.MustRegister(DiscovererStaleTargetGroups)
+
+	prometheus.MustRegister(DiscovererServicesFilteredTotal)
 }
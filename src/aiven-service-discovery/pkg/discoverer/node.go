@@ -0,0 +1,94 @@
+package discoverer
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	aiven "github.com/aiven/aiven-go-client"
+)
+
+const (
+	nodeRolePrimary = "primary"
+	nodeRoleReplica = "replica"
+)
+
+type serviceNode struct {
+	hostname string
+	role     string
+}
+
+// serviceNodes lists the hosts of a service from its connection info. These
+// are service level DNS names, which may resolve to many IPs, rather than
+// individual nodes, so round-robin services have a single host whose IPs are
+// the nodes, as described in the job spec. A role is only given where the
+// connection info says which role the host has. Services without hosts in
+// their connection info have a single host, the service hostname
+func serviceNodes(service aiven.Service) []serviceNode {
+	info := service.ConnectionInfo
+
+	var primaries, replicas, unknowns []string
+
+	switch service.Type {
+	case "pg":
+		primaries = info.PostgresURIs
+		replicas = append(replicas, info.PostgresStandbyURIs...)
+		if info.PostgresReplicaURI != "" {
+			replicas = append(replicas, info.PostgresReplicaURI)
+		}
+	case "redis":
+		primaries = info.RedisURIs
+		replicas = info.RedisSlaveURIs
+	case "cassandra":
+		unknowns = info.CassandraHosts
+	case "kafka":
+		unknowns = info.KafkaHosts
+	case "elasticsearch":
+		unknowns = info.ElasticsearchURIs
+	case "influxdb":
+		unknowns = info.InfluxDBURIs
+	}
+
+	nodes := make([]serviceNode, 0)
+	seen := make(map[string]bool)
+
+	add := func(uris []string, role string) {
+		for _, uri := range uris {
+			hostname := hostnameOf(uri)
+			if hostname == "" || seen[hostname] {
+				continue
+			}
+
+			seen[hostname] = true
+			nodes = append(nodes, serviceNode{hostname: hostname, role: role})
+		}
+	}
+
+	add(primaries, nodeRolePrimary)
+	add(replicas, nodeRoleReplica)
+	add(unknowns, "")
+
+	if len(nodes) == 0 {
+		hostname, _ := service.Hostname()
+		add([]string{hostname}, "")
+	}
+
+	return nodes
+}
+
+// hostnameOf returns the hostname of a URI, host:port or bare hostname
+func hostnameOf(uri string) string {
+	if strings.Contains(uri, "://") {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			return ""
+		}
+		return parsed.Hostname()
+	}
+
+	host, _, err := net.SplitHostPort(uri)
+	if err != nil {
+		return uri
+	}
+	return host
+}
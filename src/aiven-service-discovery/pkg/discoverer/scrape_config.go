@@ -0,0 +1,38 @@
+package discoverer
+
+// ScrapeConfig is how Prometheus should scrape the nodes of a service. Empty
+// fields are taken from DefaultScrapeConfig
+type ScrapeConfig struct {
+	Port        int
+	Scheme      string
+	MetricsPath string
+}
+
+// DefaultScrapeConfig is how the Aiven Prometheus integration serves metrics
+var DefaultScrapeConfig = ScrapeConfig{
+	Port:        9273,
+	Scheme:      "https",
+	MetricsPath: "/metrics",
+}
+
+// ScrapeConfigs are the scrape configs for each service type. Service types
+// without a scrape config use DefaultScrapeConfig
+type ScrapeConfigs map[string]ScrapeConfig
+
+func (c ScrapeConfigs) For(serviceType string) ScrapeConfig {
+	scrapeConfig := c[serviceType]
+
+	if scrapeConfig.Port == 0 {
+		scrapeConfig.Port = DefaultScrapeConfig.Port
+	}
+
+	if scrapeConfig.Scheme == "" {
+		scrapeConfig.Scheme = DefaultScrapeConfig.Scheme
+	}
+
+	if scrapeConfig.MetricsPath == "" {
+		scrapeConfig.MetricsPath = DefaultScrapeConfig.MetricsPath
+	}
+
+	return scrapeConfig
+}
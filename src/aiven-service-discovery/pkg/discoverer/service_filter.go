@@ -0,0 +1,97 @@
+package discoverer
+
+import (
+	"regexp"
+
+	aiven "github.com/aiven/aiven-go-client"
+)
+
+const (
+	filterReasonState = "state"
+	filterReasonName  = "name"
+	filterReasonType  = "type"
+)
+
+// DefaultExcludedStates are the states of Aiven services which cannot be
+// scraped, and so are not discovered unless configured otherwise
+var DefaultExcludedStates = []string{"POWEROFF", "REBUILDING"}
+
+// ServiceFilter decides which Aiven services with a Prometheus integration
+// are discovered. The zero value discovers every service
+type ServiceFilter struct {
+	excludedStates map[string]bool
+
+	includeNames *regexp.Regexp
+	excludeNames *regexp.Regexp
+
+	types map[string]bool
+}
+
+// NewServiceFilter excludes services in the given states, or
+// DefaultExcludedStates when excludeStates is nil. When includeNames is not
+// empty only services whose names match are discovered, and services whose
+// names match excludeNames are not. When types is not empty only services
+// of those types are discovered
+func NewServiceFilter(
+	excludeStates []string,
+	includeNames string,
+	excludeNames string,
+	types []string,
+) (ServiceFilter, error) {
+	if excludeStates == nil {
+		excludeStates = DefaultExcludedStates
+	}
+
+	sf := ServiceFilter{
+		excludedStates: make(map[string]bool),
+		types:          make(map[string]bool),
+	}
+
+	for _, state := range excludeStates {
+		sf.excludedStates[state] = true
+	}
+
+	for _, serviceType := range types {
+		sf.types[serviceType] = true
+	}
+
+	var err error
+
+	if includeNames != "" {
+		sf.includeNames, err = regexp.Compile(includeNames)
+		if err != nil {
+			return sf, err
+		}
+	}
+
+	if excludeNames != "" {
+		sf.excludeNames, err = regexp.Compile(excludeNames)
+		if err != nil {
+			return sf, err
+		}
+	}
+
+	return sf, nil
+}
+
+// Discover returns whether the service should be discovered, and when it
+// should not, the reason why
+func (sf ServiceFilter) Discover(service aiven.Service) (bool, string) {
+	if sf.excludedStates[service.State] {
+		return false, filterReasonState
+	}
+
+	if sf.includeNames != nil && !sf.includeNames.MatchString(service.Name) {
+		return false, filterReasonName
+	}
+
+	if sf.excludeNames != nil && sf.excludeNames.MatchString(service.Name) {
+		return false, filterReasonName
+	}
+
+	if len(sf.types) > 0 && !sf.types[service.Type] {
+		return false, filterReasonType
+	}
+
+	return true, ""
+}
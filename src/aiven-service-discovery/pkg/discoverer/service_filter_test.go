@@ -0,0 +1,60 @@
+package discoverer_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	aiven "github.com/aiven/aiven-go-client"
+
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/discoverer"
+)
+
+var _ = Describe("ServiceFilter", func() {
+	It("should discover every service when it is the zero value", func() {
+		discover, _ := discoverer.ServiceFilter{}.Discover(
+			aiven.Service{Name: "a-service", Type: "pg", State: "POWEROFF"},
+		)
+		Expect(discover).To(BeTrue())
+	})
+
+	It("should exclude powered off and rebuilding services by default", func() {
+		sf, err := discoverer.NewServiceFilter(nil, "", "", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, state := range []string{"POWEROFF", "REBUILDING"} {
+			discover, reason := sf.Discover(aiven.Service{Name: "a-service", State: state})
+			Expect(discover).To(BeFalse())
+			Expect(reason).To(Equal("state"))
+		}
+
+		discover, _ := sf.Discover(aiven.Service{Name: "a-service", State: "RUNNING"})
+		Expect(discover).To(BeTrue())
+	})
+
+	It("should filter by name and type", func() {
+		sf, err := discoverer.NewServiceFilter(
+			[]string{}, "^tenant-", "-test$", []string{"pg", "mysql"},
+		)
+		Expect(err).NotTo(HaveOccurred())
+
+		discover, _ := sf.Discover(aiven.Service{Name: "tenant-db", Type: "pg", State: "POWEROFF"})
+		Expect(discover).To(BeTrue())
+
+		discover, reason := sf.Discover(aiven.Service{Name: "other-db", Type: "pg"})
+		Expect(discover).To(BeFalse())
+		Expect(reason).To(Equal("name"))
+
+		discover, reason = sf.Discover(aiven.Service{Name: "tenant-db-test", Type: "pg"})
+		Expect(discover).To(BeFalse())
+		Expect(reason).To(Equal("name"))
+
+		discover, reason = sf.Discover(aiven.Service{Name: "tenant-cache", Type: "redis"})
+		Expect(discover).To(BeFalse())
+		Expect(reason).To(Equal("type"))
+	})
+
+	It("should return an error when a name pattern is invalid", func() {
+		_, err := discoverer.NewServiceFilter(nil, "(", "", nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -1,19 +1,156 @@
 package discoverer
 
 import (
-	"net"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
 )
 
-type prometheusTargetConfigLabels struct {
+// TargetGroupLabels are the labels of a TargetGroup
+type TargetGroupLabels struct {
+	Project     string `json:"aiven_project"`
 	ServiceName string `json:"aiven_service_name"`
 	ServiceType string `json:"aiven_service_type"`
 	Hostname    string `json:"aiven_hostname"`
 	Plan        string `json:"aiven_plan"`
 	Cloud       string `json:"aiven_cloud"`
 	NodeCount   string `json:"aiven_node_count"`
+	NodeName    string `json:"aiven_node_name"`
+
+	// NodeRole is primary or replica, and is omitted when the connection
+	// info does not say which role the node has
+	NodeRole string `json:"aiven_node_role,omitempty"`
+
+	// Stale is true when the node could not be resolved, and the targets are
+	// the IPs to which it last resolved
+	Stale string `json:"aiven_stale,omitempty"`
+
+	// Scheme and MetricsPath are meta labels which tell Prometheus how to
+	// scrape the targets, so that the scrape config does not have to
+	Scheme      string `json:"__scheme__"`
+	MetricsPath string `json:"__metrics_path__"`
+
+	// Mapped are the labels configured by LabelMappings
+	Mapped map[string]string `json:"-"`
+}
+
+// MarshalJSON marshals the mapped labels alongside the other labels, after
+// them and sorted by name, so that the order of the labels is stable
+func (l TargetGroupLabels) MarshalJSON() ([]byte, error) {
+	type labels TargetGroupLabels
+
+	encoded, err := json.Marshal(labels(l))
+	if err != nil || len(l.Mapped) == 0 {
+		return encoded, err
+	}
+
+	names := make([]string, 0, len(l.Mapped))
+	for name := range l.Mapped {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.Write(encoded[:len(encoded)-1])
+
+	for _, name := range names {
+		encodedName, _ := json.Marshal(name)
+		encodedValue, _ := json.Marshal(l.Mapped[name])
+
+		buf.WriteByte(',')
+		buf.Write(encodedName)
+		buf.WriteByte(':')
+		buf.Write(encodedValue)
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON unmarshals the labels which are not fields into the mapped
+// labels, so that target groups which are read back from a file are written
+// again unchanged
+func (l *TargetGroupLabels) UnmarshalJSON(data []byte) error {
+	type labels TargetGroupLabels
+
+	var fields labels
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+
+	var all map[string]string
+	err = json.Unmarshal(data, &all)
+	if err != nil {
+		return err
+	}
+
+	*l = TargetGroupLabels(fields)
+
+	for name, value := range all {
+		if targetGroupLabelFields[name] {
+			continue
+		}
+
+		if l.Mapped == nil {
+			l.Mapped = make(map[string]string)
+		}
+		l.Mapped[name] = value
+	}
+
+	return nil
+}
+
+// targetGroupLabelFields are the names of the labels which are fields of
+// TargetGroupLabels
+var targetGroupLabelFields = func() map[string]bool {
+	names := make(map[string]bool)
+
+	t := reflect.TypeOf(TargetGroupLabels{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+
+	return names
+}()
+
+// TargetGroup is a target group for a single node of a service, with a
+// target for each of the IPs of the node. Lists of target groups are the
+// format of both Prometheus file_sd_config and http_sd_config
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  TargetGroupLabels `json:"labels"`
+}
+
+func targetGroupKey(target TargetGroup) string {
+	return strings.Join([]string{
+		target.Labels.Project,
+		target.Labels.ServiceName,
+		target.Labels.NodeName,
+	}, "/")
+}
+
+// sortTargetGroups sorts the target groups by project, service and node, and
+// the targets of each group, because discovery happens concurrently and DNS
+// does not return IPs in a stable order
+func sortTargetGroups(targets []TargetGroup) {
+	for _, target := range targets {
+		sort.Strings(target.Targets)
+	}
+
+	orderTargetGroups(targets)
 }
 
-type prometheusTargetConfig struct {
-	Targets []net.IP                     `json:"targets"`
-	Labels  prometheusTargetConfigLabels `json:"labels"`
+// orderTargetGroups sorts only the target groups, leaving the targets of
+// each group alone, so that groups whose targets are already sorted, and may
+// be read concurrently, can be merged
+func orderTargetGroups(targets []TargetGroup) {
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targetGroupKey(targets[i]) < targetGroupKey(targets[j])
+	})
 }
@@ -1,21 +1,79 @@
 package fakes
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	aiven "github.com/aiven/aiven-go-client"
 )
 
 type FakeFetcher struct {
+	mutex sync.Mutex
+
+	project      string
 	shouldReturn []aiven.Service
+	lastSuccess  time.Time
+	subscribers  []chan<- struct{}
+	refetches    int
+}
+
+func NewFakeFetcher(project string) *FakeFetcher {
+	return &FakeFetcher{project: project, shouldReturn: make([]aiven.Service, 0)}
+}
+
+func (f *FakeFetcher) Start(_ context.Context)     {}
+func (f *FakeFetcher) Stop()                       {}
+func (f *FakeFetcher) SetInterval(_ time.Duration) {}
+func (f *FakeFetcher) Project() string             { return f.project }
+
+func (f *FakeFetcher) Services() []aiven.Service {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.shouldReturn
+}
+
+func (f *FakeFetcher) LastSuccess() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.lastSuccess
 }
 
-func NewFakeFetcher() *FakeFetcher {
-	return &FakeFetcher{shouldReturn: make([]aiven.Service, 0)}
+func (f *FakeFetcher) Subscribe(notify chan<- struct{}) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.subscribers = append(f.subscribers, notify)
+}
+
+func (f *FakeFetcher) Refetch() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.refetches++
+}
+
+// Refetches is the number of times Refetch has been called
+func (f *FakeFetcher) Refetches() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.refetches
 }
 
-func (f *FakeFetcher) Start()                         {}
-func (f *FakeFetcher) Stop()                          {}
-func (f *FakeFetcher) SetInterval(_ time.Duration)    {}
-func (f *FakeFetcher) Services() []aiven.Service      { return f.shouldReturn }
-func (f *FakeFetcher) ShouldReturn(s []aiven.Service) { f.shouldReturn = s }
+func (f *FakeFetcher) ShouldReturn(s []aiven.Service) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.shouldReturn = s
+	f.lastSuccess = time.Now()
+
+	for _, subscriber := range f.subscribers {
+		select {
+		case subscriber <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package fetcher
 
 import (
+	"context"
+	"reflect"
 	"sync"
 	"time"
 
 	"code.cloudfoundry.org/lager"
 	aiven "github.com/aiven/aiven-go-client"
+
+	"github.com/alphagov/paas-observability-release/src/health"
+
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/aivenapi"
 )
 
 func init() {
@@ -18,9 +24,26 @@ const (
 )
 
 type Fetcher interface {
+	Project() string
 	Services() []aiven.Service
 
-	Start()
+	// LastSuccess is when services were last fetched successfully
+	LastSuccess() time.Time
+
+	// Subscribe registers a channel which is notified, without blocking,
+	// whenever the fetched services change. The channel should be buffered
+	// so that a change is not missed while the subscriber is busy
+	Subscribe(notify chan<- struct{})
+
+	// Refetch fetches as soon as possible, without waiting for the
+	// interval, such as when the services have just been changed. It does
+	// not block, and many calls before the fetch result in a single fetch
+	Refetch()
+
+	// Start fetches and then fetches every interval until the context is
+	// done or Stop is called. Stop waits for an in-flight fetch to be
+	// cancelled, and is safe to call more than once
+	Start(context.Context)
 	Stop()
 
 	SetInterval(time.Duration)
@@ -32,24 +55,31 @@ type fetcher struct {
 
 	logger lager.Logger
 
-	stop chan struct{}
-	wg   sync.WaitGroup
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 
 	interval time.Duration
+	refetch  chan struct{}
 
 	servicesMutex sync.RWMutex
 	services      []aiven.Service
+
+	lastSuccess health.Timestamp
+
+	subscribersMutex sync.Mutex
+	subscribers      []chan<- struct{}
 }
 
 func NewFetcher(
 	aivenProject string,
 	aivenAPIToken string,
+	backoff aivenapi.Backoff,
 
 	logger lager.Logger,
 ) (Fetcher, error) {
 	lsession := logger.Session("fetcher", lager.Data{"project": aivenProject})
 
-	aivenClient, err := aiven.NewTokenClient(aivenAPIToken, userAgent)
+	aivenClient, err := aivenapi.NewClient(aivenAPIToken, userAgent, backoff)
 	if err != nil {
 		lsession.Error("err-aiven-new-token-client", err)
 		return nil, err
@@ -61,14 +91,17 @@ func NewFetcher(
 
 		logger: lsession,
 
-		stop: make(chan struct{}),
-
 		interval: defaultInterval,
+		refetch:  make(chan struct{}, 1),
 	}
 
 	return &f, nil
 }
 
+func (f *fetcher) Project() string {
+	return f.aivenProject
+}
+
 func (f *fetcher) Services() []aiven.Service {
 	f.servicesMutex.RLock()
 	defer f.servicesMutex.RUnlock()
@@ -76,23 +109,57 @@ func (f *fetcher) Services() []aiven.Service {
 	return f.services
 }
 
-func (f *fetcher) fetch() {
+func (f *fetcher) LastSuccess() time.Time {
+	return f.lastSuccess.LastSuccess()
+}
+
+func (f *fetcher) Subscribe(notify chan<- struct{}) {
+	f.subscribersMutex.Lock()
+	defer f.subscribersMutex.Unlock()
+
+	f.subscribers = append(f.subscribers, notify)
+}
+
+func (f *fetcher) Refetch() {
+	select {
+	case f.refetch <- struct{}{}:
+	default:
+		// A fetch has already been requested
+	}
+}
+
+func (f *fetcher) notify() {
+	f.subscribersMutex.Lock()
+	defer f.subscribersMutex.Unlock()
+
+	for _, subscriber := range f.subscribers {
+		select {
+		case subscriber <- struct{}{}:
+		default:
+			// The subscriber already has a notification it has not handled
+		}
+	}
+}
+
+func (f *fetcher) fetch(ctx context.Context) {
 	lsession := f.logger.Session("fetch")
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	FetcherFetchesTotal.Inc()
+	FetcherFetchesTotal.WithLabelValues(f.aivenProject).Inc()
+
+	aivenClient, cancel := aivenapi.WithTimeout(ctx, f.aivenClient, aivenapi.DefaultTimeout)
+	defer cancel()
 
-	aivenServices, err := f.aivenClient.Services.List(f.aivenProject)
+	aivenServices, err := aivenClient.Services.List(f.aivenProject)
 	if err != nil {
 		lsession.Error("err-aiven-services-list", err)
-		FetcherAivenListServicesErrorsTotal.Inc()
+		FetcherAivenListServicesErrorsTotal.WithLabelValues(
+			f.aivenProject, aivenapi.StatusClass(err),
+		).Inc()
 		return
 	}
 
-	f.servicesMutex.Lock()
-	defer f.servicesMutex.Unlock()
-
 	services := make([]aiven.Service, 0)
 	for _, service := range aivenServices {
 		if service == nil {
@@ -102,33 +169,51 @@ func (f *fetcher) fetch() {
 		}
 	}
 
+	f.servicesMutex.Lock()
+	changed := f.services == nil || !reflect.DeepEqual(f.services, services)
 	f.services = services
+	f.servicesMutex.Unlock()
+
+	f.lastSuccess.Succeeded()
+
+	if changed {
+		lsession.Info("services-changed", lager.Data{"services": len(services)})
+		f.notify()
+	}
 }
 
-func (f *fetcher) loop() {
+func (f *fetcher) loop(ctx context.Context) {
 	lsession := f.logger.Session("loop")
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	f.wg.Add(1)
+	defer f.wg.Done()
 
 	for {
 		select {
 		case <-time.After(f.interval):
-			f.fetch()
-		case <-f.stop:
-			f.wg.Done()
+			f.fetch(ctx)
+		case <-f.refetch:
+			f.fetch(ctx)
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (f *fetcher) Start() {
+// Start fetches synchronously before starting the loop, so that the services
+// are available as soon as possible after starting
+func (f *fetcher) Start(ctx context.Context) {
 	lsession := f.logger.Session("start")
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	go f.loop()
+	ctx, f.cancel = context.WithCancel(ctx)
+
+	f.fetch(ctx)
+
+	f.wg.Add(1)
+	go f.loop(ctx)
 }
 
 func (f *fetcher) Stop() {
@@ -136,7 +221,9 @@ func (f *fetcher) Stop() {
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	close(f.stop)
+	if f.cancel != nil {
+		f.cancel()
+	}
 	f.wg.Wait()
 }
 
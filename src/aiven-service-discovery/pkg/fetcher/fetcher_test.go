@@ -1,6 +1,7 @@
 package fetcher_test
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
@@ -13,6 +14,7 @@ import (
 	"code.cloudfoundry.org/lager"
 	aiven "github.com/aiven/aiven-go-client"
 
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/aivenapi"
 	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/fetcher"
 	h "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/testhelpers"
 )
@@ -25,13 +27,26 @@ const (
 	evInterval = "10ms"
 )
 
+var backoff = aivenapi.Backoff{
+	InitialInterval: 10 * time.Millisecond,
+	MaxInterval:     50 * time.Millisecond,
+	Exponent:        2,
+	MaxRetries:      2,
+}
+
 var _ = Describe("Fetcher", func() {
 	var (
 		f      fetcher.Fetcher
 		logger lager.Logger
 
-		fetchAivenListServicesErrorsTotal float64
-		fetchesTotal                      float64
+		changed chan struct{}
+
+		fetchAivenListServicesErrors4xxTotal float64
+		fetchAivenListServicesErrors5xxTotal float64
+		fetchAivenListServicesCancelledTotal float64
+		fetchesTotal                         float64
+		aivenAPIRetries4xxTotal              float64
+		aivenAPIRetries5xxTotal              float64
 	)
 
 	BeforeSuite(func() {
@@ -50,24 +65,38 @@ var _ = Describe("Fetcher", func() {
 		logger = lager.NewLogger("fetcher-test")
 		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
 
-		f, err = fetcher.NewFetcher(project, token, logger)
+		f, err = fetcher.NewFetcher(project, token, backoff, logger)
 		Expect(err).NotTo(HaveOccurred())
 
 		By("checking before starting")
+		Expect(f.Project()).To(Equal(project))
 		Expect(f.Services()).To(HaveLen(0))
+		Expect(f.LastSuccess().IsZero()).To(BeTrue())
 
 		By("setting the metric values before each test")
 		fetchesTotal = h.CurrentMetricValue(
-			fetcher.FetcherFetchesTotal,
+			fetcher.FetcherFetchesTotal.WithLabelValues(project),
+		)
+		fetchAivenListServicesErrors4xxTotal = h.CurrentMetricValue(
+			fetcher.FetcherAivenListServicesErrorsTotal.WithLabelValues(project, "4xx"),
+		)
+		fetchAivenListServicesErrors5xxTotal = h.CurrentMetricValue(
+			fetcher.FetcherAivenListServicesErrorsTotal.WithLabelValues(project, "5xx"),
+		)
+		fetchAivenListServicesCancelledTotal = h.CurrentMetricValue(
+			fetcher.FetcherAivenListServicesErrorsTotal.WithLabelValues(project, "cancelled"),
 		)
-		fetchAivenListServicesErrorsTotal = h.CurrentMetricValue(
-			fetcher.FetcherAivenListServicesErrorsTotal,
+		aivenAPIRetries4xxTotal = h.CurrentMetricValue(
+			aivenapi.AivenAPIRetriesTotal.WithLabelValues("4xx"),
+		)
+		aivenAPIRetries5xxTotal = h.CurrentMetricValue(
+			aivenapi.AivenAPIRetriesTotal.WithLabelValues("5xx"),
 		)
 
 		f.SetInterval(100 * time.Millisecond) // We want fast tests
 
-		By("starting")
-		f.Start()
+		changed = make(chan struct{}, 1)
+		f.Subscribe(changed)
 	})
 
 	AfterEach(func() {
@@ -109,18 +138,25 @@ var _ = Describe("Fetcher", func() {
 			},
 		)
 
+		By("starting")
+		f.Start(context.Background())
+
+		By("checking it fetched when it started")
+		Expect(f.Services()).To(HaveLen(1))
+
 		By("polling")
-		Eventually(f.Services, evTimeout, evInterval).Should(HaveLen(0))
-		Eventually(f.Services, evTimeout, evInterval).Should(HaveLen(1))
 		Eventually(f.Services, evTimeout, evInterval).Should(HaveLen(2))
 		Eventually(f.Services, evTimeout, evInterval).Should(HaveLen(0))
 
+		By("checking the last success")
+		Expect(f.LastSuccess()).To(BeTemporally("~", time.Now(), time.Second))
+
 		By("checking the metrics")
-		Expect(fetcher.FetcherFetchesTotal).To(
+		Expect(fetcher.FetcherFetchesTotal.WithLabelValues(project)).To(
 			h.MetricIncrementedBy(fetchesTotal, ">=", 3),
 		)
-		Expect(fetcher.FetcherAivenListServicesErrorsTotal).To(
-			h.MetricIncrementedBy(fetchAivenListServicesErrorsTotal, "==", 0),
+		Expect(fetcher.FetcherAivenListServicesErrorsTotal.WithLabelValues(project, "4xx")).To(
+			h.MetricIncrementedBy(fetchAivenListServicesErrors4xxTotal, "==", 0),
 		)
 	})
 
@@ -158,17 +194,249 @@ var _ = Describe("Fetcher", func() {
 			},
 		)
 
+		By("starting")
+		f.Start(context.Background())
+
 		By("polling")
 		Eventually(f.Services, evTimeout, evInterval).Should(HaveLen(1))
 		Eventually(f.Services, evTimeout, evInterval).Should(HaveLen(2))
 		Eventually(f.Services, evTimeout, evInterval).Should(HaveLen(1))
 
 		By("checking the metrics")
-		Expect(fetcher.FetcherFetchesTotal).To(
+		Expect(fetcher.FetcherFetchesTotal.WithLabelValues(project)).To(
 			h.MetricIncrementedBy(fetchesTotal, ">=", 6),
 		)
-		Expect(fetcher.FetcherAivenListServicesErrorsTotal).To(
-			h.MetricIncrementedBy(fetchAivenListServicesErrorsTotal, ">=", 1),
+		Expect(fetcher.FetcherAivenListServicesErrorsTotal.WithLabelValues(project, "4xx")).To(
+			h.MetricIncrementedBy(fetchAivenListServicesErrors4xxTotal, ">=", 1),
+		)
+	})
+
+	It("should notify subscribers when the services change", func() {
+		calls := 0
+
+		httpmock.RegisterResponder(
+			"GET",
+			fmt.Sprintf("https://api.aiven.io/v1/project/%s/service", project),
+			func(req *http.Request) (*http.Response, error) {
+				calls++
+
+				services := []aiven.Service{
+					aiven.Service{Name: "a-service"},
+				}
+				if calls > 5 {
+					services = append(services, aiven.Service{Name: "another-service"})
+				}
+
+				resp, _ := httpmock.NewJsonResponse(200, map[string]interface{}{
+					"errors":   []string{},
+					"message":  "Completed",
+					"services": services,
+				})
+
+				return resp, nil
+			},
+		)
+
+		By("starting")
+		f.Start(context.Background())
+
+		By("polling for a notification after the first fetch")
+		Eventually(changed, evTimeout, evInterval).Should(Receive())
+		Expect(f.Services()).To(HaveLen(1))
+
+		By("polling for a notification when a service is added")
+		Eventually(changed, evTimeout, evInterval).Should(Receive())
+		Expect(f.Services()).To(HaveLen(2))
+		Expect(calls).To(BeNumerically(">", 5))
+	})
+
+	It("should fetch as soon as it starts", func() {
+		httpmock.RegisterResponder(
+			"GET",
+			fmt.Sprintf("https://api.aiven.io/v1/project/%s/service", project),
+			httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+				"errors":   []string{},
+				"message":  "Completed",
+				"services": []aiven.Service{aiven.Service{Name: "a-service"}},
+			}),
+		)
+
+		f.SetInterval(time.Hour)
+
+		By("starting")
+		f.Start(context.Background())
+
+		By("checking the services were fetched before it started")
+		Expect(f.Services()).To(HaveLen(1))
+		Expect(f.LastSuccess()).To(BeTemporally("~", time.Now(), time.Second))
+		Expect(changed).To(Receive())
+	})
+
+	It("should fetch as soon as a refetch is requested", func() {
+		httpmock.RegisterResponder(
+			"GET",
+			fmt.Sprintf("https://api.aiven.io/v1/project/%s/service", project),
+			httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+				"errors":   []string{},
+				"message":  "Completed",
+				"services": []aiven.Service{aiven.Service{Name: "a-service"}},
+			}),
+		)
+
+		f.SetInterval(time.Hour)
+
+		By("starting")
+		f.Start(context.Background())
+		Expect(httpmock.GetTotalCallCount()).To(Equal(1))
+
+		By("requesting a refetch without waiting for the interval")
+		f.Refetch()
+		Eventually(httpmock.GetTotalCallCount, evTimeout, evInterval).Should(Equal(2))
+	})
+
+	It("should cancel an in-flight fetch when it is stopped", func() {
+		calls := 0
+		blocked := make(chan struct{}, 1)
+
+		httpmock.RegisterResponder(
+			"GET",
+			fmt.Sprintf("https://api.aiven.io/v1/project/%s/service", project),
+			func(req *http.Request) (*http.Response, error) {
+				calls++
+
+				if calls > 1 {
+					blocked <- struct{}{}
+					<-req.Context().Done()
+					return nil, req.Context().Err()
+				}
+
+				return httpmock.NewJsonResponse(200, map[string]interface{}{
+					"errors":   []string{},
+					"message":  "Completed",
+					"services": []aiven.Service{aiven.Service{Name: "a-service"}},
+				})
+			},
+		)
+
+		By("starting")
+		f.Start(context.Background())
+
+		By("waiting for a fetch which does not return")
+		Eventually(blocked, evTimeout, evInterval).Should(Receive())
+
+		By("stopping, which cancels the fetch")
+		stopped := make(chan struct{})
+		go func() {
+			f.Stop()
+			close(stopped)
+		}()
+		Eventually(stopped, evTimeout, evInterval).Should(BeClosed())
+
+		By("checking the services from before are kept")
+		Expect(f.Services()).To(HaveLen(1))
+		Expect(fetcher.FetcherAivenListServicesErrorsTotal.WithLabelValues(project, "cancelled")).To(
+			h.MetricIncrementedBy(fetchAivenListServicesCancelledTotal, "==", 1),
+		)
+	})
+
+	It("should stop fetching when the context is done", func() {
+		httpmock.RegisterResponder(
+			"GET",
+			fmt.Sprintf("https://api.aiven.io/v1/project/%s/service", project),
+			httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+				"errors":   []string{},
+				"message":  "Completed",
+				"services": []aiven.Service{},
+			}),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		By("starting")
+		f.Start(ctx)
+		Eventually(func() int {
+			return httpmock.GetTotalCallCount()
+		}, evTimeout, evInterval).Should(BeNumerically(">=", 2))
+
+		By("cancelling the context")
+		cancel()
+		time.Sleep(200 * time.Millisecond)
+		callsAfterCancel := httpmock.GetTotalCallCount()
+
+		Consistently(func() int {
+			return httpmock.GetTotalCallCount()
+		}, "500ms", evInterval).Should(Equal(callsAfterCancel))
+
+		By("stopping more than once")
+		f.Stop()
+		f.Stop()
+	})
+
+	It("should retry when rate limited, waiting for as long as Aiven says", func() {
+		calls := 0
+
+		httpmock.RegisterResponder(
+			"GET",
+			fmt.Sprintf("https://api.aiven.io/v1/project/%s/service", project),
+			func(req *http.Request) (*http.Response, error) {
+				calls++
+
+				if calls == 1 {
+					resp := httpmock.NewStringResponse(429, "")
+					resp.Header.Set("Retry-After", "1")
+					return resp, nil
+				}
+
+				return httpmock.NewJsonResponse(200, map[string]interface{}{
+					"errors":   []string{},
+					"message":  "Completed",
+					"services": []aiven.Service{aiven.Service{Name: "a-service"}},
+				})
+			},
+		)
+
+		f.SetInterval(time.Hour)
+
+		By("starting")
+		start := time.Now()
+		f.Start(context.Background())
+
+		By("checking the services were fetched after the retry")
+		Expect(f.Services()).To(HaveLen(1))
+		Expect(calls).To(Equal(2))
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+
+		By("checking the metrics")
+		Expect(aivenapi.AivenAPIRetriesTotal.WithLabelValues("4xx")).To(
+			h.MetricIncrementedBy(aivenAPIRetries4xxTotal, "==", 1),
+		)
+		Expect(fetcher.FetcherAivenListServicesErrorsTotal.WithLabelValues(project, "4xx")).To(
+			h.MetricIncrementedBy(fetchAivenListServicesErrors4xxTotal, "==", 0),
+		)
+	})
+
+	It("should give up after the retries when Aiven fails", func() {
+		httpmock.RegisterResponder(
+			"GET",
+			fmt.Sprintf("https://api.aiven.io/v1/project/%s/service", project),
+			httpmock.NewStringResponder(503, "Service Unavailable"),
+		)
+
+		f.SetInterval(time.Hour)
+
+		By("starting")
+		f.Start(context.Background())
+
+		By("checking it retried before giving up")
+		Expect(httpmock.GetTotalCallCount()).To(Equal(1 + backoff.MaxRetries))
+		Expect(f.LastSuccess().IsZero()).To(BeTrue())
+
+		By("checking the metrics")
+		Expect(aivenapi.AivenAPIRetriesTotal.WithLabelValues("5xx")).To(
+			h.MetricIncrementedBy(aivenAPIRetries5xxTotal, "==", float64(backoff.MaxRetries)),
+		)
+		Expect(fetcher.FetcherAivenListServicesErrorsTotal.WithLabelValues(project, "5xx")).To(
+			h.MetricIncrementedBy(fetchAivenListServicesErrors5xxTotal, "==", 1),
 		)
 	})
 })
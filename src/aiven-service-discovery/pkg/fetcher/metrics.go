@@ -5,15 +5,15 @@ import (
 )
 
 var (
-	FetcherAivenListServicesErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	FetcherAivenListServicesErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "fetcher_aiven_service_list_errors_total",
-		Help: "Counter of total number of Aiven list services API failures",
-	})
+		Help: "Counter of total number of Aiven list services API failures, by the HTTP status class of the failure",
+	}, []string{"project", "status_class"})
 
-	FetcherFetchesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	FetcherFetchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "fetcher_fetches_total",
 		Help: "Counter of total number of fetcher calls",
-	})
+	}, []string{"project"})
 )
 
 func initMetrics() {
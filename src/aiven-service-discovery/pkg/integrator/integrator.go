@@ -1,12 +1,14 @@
 package integrator
 
 import (
+	"context"
 	"sync"
 	"time"
 
 	"code.cloudfoundry.org/lager"
 	aiven "github.com/aiven/aiven-go-client"
 
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/aivenapi"
 	f "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/fetcher"
 )
 
@@ -15,15 +17,32 @@ func init() {
 }
 
 const (
-	defaultInterval = 15 * time.Second
-	userAgent       = "govuk-paas-aiven-service-discovery-integrator"
+	defaultInterval          = 15 * time.Second
+	defaultReconcileInterval = 10 * time.Minute
+
+	// createdGracePeriod is how long an integration which was created is
+	// waited for in the fetched services before it is created again
+	createdGracePeriod = 10 * time.Minute
+
+	userAgent = "govuk-paas-aiven-service-discovery-integrator"
 )
 
 type Integrator interface {
-	Start()
+	// PlannedActions are the changes which the most recent dry run would
+	// have made
+	PlannedActions() []PlannedAction
+
+	// Start integrates whenever the services change, and every interval,
+	// until the context is done or Stop is called. Stop waits for in-flight
+	// calls to Aiven to be cancelled, and is safe to call more than once
+	Start(context.Context)
 	Stop()
 
 	SetInterval(time.Duration)
+
+	// SetReconcileInterval sets how often existing integrations are
+	// reconciled when the services have not changed
+	SetReconcileInterval(time.Duration)
 }
 
 type integrator struct {
@@ -31,20 +50,52 @@ type integrator struct {
 	aivenClient               aiven.Client
 	aivenPrometheusEndpointID string
 
+	serviceTypes ServiceTypes
+	reconcile    Reconcile
+	dryRun       bool
+
 	fetcher f.Fetcher
 
 	logger lager.Logger
 
-	stop chan struct{}
-	wg   sync.WaitGroup
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 
+	// changed is notified by the fetcher when the services change, and the
+	// interval is a fallback for retrying failures. Services whose
+	// integrations were created are skipped until they are fetched, so the
+	// interval does not create them again from the same services
+	changed  chan struct{}
 	interval time.Duration
+
+	// created are the services, and when, whose integrations were created
+	// but are not yet in the fetched services. It is only used by the loop
+	created map[string]time.Time
+
+	// Reconciling lists the integrations of every service, so it only
+	// happens when the services change, or every reconcileInterval.
+	// lastReconcile is only used by the loop
+	reconcileInterval time.Duration
+	lastReconcile     time.Time
+
+	// planning and reconcilePlanning are only used by the loop, and are
+	// published to planned at the end of each cycle. The actions planned by
+	// reconciling are kept until the next time it reconciles
+	planning          []PlannedAction
+	reconcilePlanning []PlannedAction
+	plannedMutex      sync.RWMutex
+	planned           []PlannedAction
 }
 
 func NewIntegrator(
 	aivenProject string,
 	aivenAPIToken string,
 	aivenPrometheusEndpointID string,
+	backoff aivenapi.Backoff,
+
+	serviceTypes ServiceTypes,
+	reconcile Reconcile,
+	dryRun bool,
 
 	fetcher f.Fetcher,
 
@@ -52,7 +103,7 @@ func NewIntegrator(
 ) (Integrator, error) {
 	lsession := logger.Session("integrator", lager.Data{"project": aivenProject})
 
-	aivenClient, err := aiven.NewTokenClient(aivenAPIToken, userAgent)
+	aivenClient, err := aivenapi.NewClient(aivenAPIToken, userAgent, backoff)
 	if err != nil {
 		lsession.Error("err-aiven-new-token-client", err)
 		return nil, err
@@ -63,50 +114,91 @@ func NewIntegrator(
 		aivenClient:               *aivenClient,
 		aivenPrometheusEndpointID: aivenPrometheusEndpointID,
 
+		serviceTypes: serviceTypes,
+		reconcile:    reconcile,
+		dryRun:       dryRun,
+
 		fetcher: fetcher,
 
 		logger: lsession,
 
-		stop: make(chan struct{}),
-
+		changed:  make(chan struct{}, 1),
 		interval: defaultInterval,
+
+		reconcileInterval: defaultReconcileInterval,
+
+		created: make(map[string]time.Time),
 	}
 
+	fetcher.Subscribe(i.changed)
+
 	return &i, nil
 }
 
-func (i *integrator) integrateService(s aiven.Service) {
+// integrateService creates the Prometheus integration of the service, and
+// returns whether it was created
+func (i *integrator) integrateService(ctx context.Context, s aiven.Service) bool {
 	lsession := i.logger.Session(
 		"integrate-service", lager.Data{"service": s.Name},
 	)
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	IntegratorCreateServiceIntegrationsTotal.Inc()
+	request := aiven.CreateServiceIntegrationRequest{
+		DestinationEndpointID: &i.aivenPrometheusEndpointID,
+		SourceService:         &s.Name,
+		IntegrationType:       "prometheus",
+	}
 
-	_, err := i.aivenClient.ServiceIntegrations.Create(
-		i.aivenProject,
-		aiven.CreateServiceIntegrationRequest{
-			DestinationEndpointID: &i.aivenPrometheusEndpointID,
-			SourceService:         &s.Name,
-			IntegrationType:       "prometheus",
-		},
-	)
+	if i.dryRun {
+		lsession.Info("dry-run-create-service-integration", lager.Data{
+			"request": request,
+		})
+
+		IntegratorDryRunCreateServiceIntegrationsTotal.WithLabelValues(i.aivenProject).Inc()
+
+		i.plan(PlannedAction{
+			Service: s.Name,
+			Action:  plannedActionCreate,
+			Request: &request,
+		})
+
+		return false
+	}
+
+	IntegratorCreateServiceIntegrationsTotal.WithLabelValues(i.aivenProject).Inc()
+
+	aivenClient, cancel := aivenapi.WithTimeout(ctx, i.aivenClient, aivenapi.DefaultTimeout)
+	defer cancel()
+
+	_, err := aivenClient.ServiceIntegrations.Create(i.aivenProject, request)
 
 	if err != nil {
 		lsession.Error("err-aiven-create-service-integration", err)
 
-		IntegratorCreateServiceIntegrationErrorsTotal.Inc()
+		IntegratorCreateServiceIntegrationErrorsTotal.WithLabelValues(
+			i.aivenProject, aivenapi.StatusClass(err),
+		).Inc()
+
+		return false
 	}
+
+	return true
 }
 
-func (i *integrator) integrate() {
+// integrate creates the missing Prometheus integrations, and when reconcile
+// is true, also reconciles the existing integrations
+func (i *integrator) integrate(ctx context.Context, reconcile bool) {
 	lsession := i.logger.Session("integrate")
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
+	i.planning = make([]PlannedAction, 0)
+	defer i.publishPlan()
+
 	services := i.fetcher.Services()
 
+	servicesWithPrometheus := make([]aiven.Service, 0)
 	servicesWithoutPrometheus := make([]aiven.Service, 0)
 	for _, service := range services {
 		needsPrometheus := true
@@ -118,46 +210,158 @@ func (i *integrator) integrate() {
 
 		if needsPrometheus {
 			servicesWithoutPrometheus = append(servicesWithoutPrometheus, service)
+		} else {
+			servicesWithPrometheus = append(servicesWithPrometheus, service)
 		}
 	}
 
+	i.forgetCreated(servicesWithoutPrometheus)
+
 	eligibleServices := make([]aiven.Service, 0)
 	for _, service := range servicesWithoutPrometheus {
-		switch service.Type {
-		case "elasticsearch":
-			eligibleServices = append(eligibleServices, service)
+		if _, ok := i.created[service.Name]; ok {
+			lsession.Info("skip-created-service", lager.Data{
+				"service": service.Name,
+			})
+
+			continue
+		}
+
+		integrate, reason := i.serviceTypes.Integrate(service.Type)
+		if !integrate {
+			lsession.Info("skip-service", lager.Data{
+				"service":      service.Name,
+				"service-type": service.Type,
+				"reason":       reason,
+			})
+
+			IntegratorServicesSkippedTotal.WithLabelValues(
+				i.aivenProject, service.Type, reason,
+			).Inc()
+
+			continue
 		}
+
+		eligibleServices = append(eligibleServices, service)
 	}
 
+	created := false
 	for _, service := range eligibleServices {
-		i.integrateService(service)
+		if ctx.Err() != nil {
+			lsession.Info("cancelled")
+			break
+		}
+
+		if i.integrateService(ctx, service) {
+			i.created[service.Name] = time.Now()
+			created = true
+		}
+	}
+
+	// The fetcher is asked for the new integrations straight away, so that
+	// they are discovered without waiting for the fetcher interval
+	if created {
+		i.fetcher.Refetch()
+	}
+
+	if ctx.Err() != nil {
+		return
 	}
+
+	if !reconcile || !(i.reconcile.Enabled || i.reconcile.RemoveDenied) {
+		return
+	}
+
+	i.reconcilePlanning = make([]PlannedAction, 0)
+
+	for _, service := range servicesWithPrometheus {
+		if ctx.Err() != nil {
+			lsession.Info("cancelled")
+			return
+		}
+
+		// Only types which are explicitly denied are removed, because an
+		// unsupported type may have been integrated by hand
+		if integrate, reason := i.serviceTypes.Integrate(service.Type); !integrate {
+			if reason == skipReasonDenied && i.reconcile.RemoveDenied {
+				i.reconcileDeniedService(ctx, service)
+			}
+			continue
+		}
+
+		if i.reconcile.Enabled {
+			i.reconcileService(ctx, service)
+		}
+	}
+
+	i.lastReconcile = time.Now()
 }
 
-func (i *integrator) loop() {
+// forgetCreated forgets the created integrations which are in the fetched
+// services, along with those of services which no longer exist, or which
+// have not appeared within the grace period so should be created again
+func (i *integrator) forgetCreated(servicesWithoutPrometheus []aiven.Service) {
+	waiting := make(map[string]bool, len(servicesWithoutPrometheus))
+	for _, service := range servicesWithoutPrometheus {
+		waiting[service.Name] = true
+	}
+
+	for name, createdAt := range i.created {
+		if !waiting[name] || time.Since(createdAt) > createdGracePeriod {
+			delete(i.created, name)
+		}
+	}
+}
+
+func (i *integrator) plan(action PlannedAction) {
+	action.Project = i.aivenProject
+	i.planning = append(i.planning, action)
+}
+
+func (i *integrator) planReconcile(action PlannedAction) {
+	action.Project = i.aivenProject
+	i.reconcilePlanning = append(i.reconcilePlanning, action)
+}
+
+func (i *integrator) publishPlan() {
+	i.plannedMutex.Lock()
+	defer i.plannedMutex.Unlock()
+
+	planned := make([]PlannedAction, 0, len(i.planning)+len(i.reconcilePlanning))
+	planned = append(planned, i.planning...)
+	planned = append(planned, i.reconcilePlanning...)
+
+	i.planned = planned
+}
+
+func (i *integrator) loop(ctx context.Context) {
 	lsession := i.logger.Session("loop")
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	i.wg.Add(1)
+	defer i.wg.Done()
 
 	for {
 		select {
 		case <-time.After(i.interval):
-			i.integrate()
-		case <-i.stop:
-			i.wg.Done()
+			i.integrate(ctx, time.Since(i.lastReconcile) >= i.reconcileInterval)
+		case <-i.changed:
+			i.integrate(ctx, true)
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (i *integrator) Start() {
+func (i *integrator) Start(ctx context.Context) {
 	lsession := i.logger.Session("start")
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	go i.loop()
+	ctx, i.cancel = context.WithCancel(ctx)
+
+	i.wg.Add(1)
+	go i.loop(ctx)
 }
 
 func (i *integrator) Stop() {
@@ -165,10 +369,23 @@ func (i *integrator) Stop() {
 	lsession.Info("begin")
 	defer lsession.Info("end")
 
-	close(i.stop)
+	if i.cancel != nil {
+		i.cancel()
+	}
 	i.wg.Wait()
 }
 
+func (i *integrator) PlannedActions() []PlannedAction {
+	i.plannedMutex.RLock()
+	defer i.plannedMutex.RUnlock()
+
+	return i.planned
+}
+
 func (i *integrator) SetInterval(interval time.Duration) {
 	i.interval = interval
 }
+
+func (i *integrator) SetReconcileInterval(interval time.Duration) {
+	i.reconcileInterval = interval
+}
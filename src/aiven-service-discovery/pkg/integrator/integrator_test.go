@@ -1,8 +1,14 @@
 package integrator_test
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -13,8 +19,12 @@ import (
 	"code.cloudfoundry.org/lager"
 	aiven "github.com/aiven/aiven-go-client"
 
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/aivenapi"
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/discoverer"
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/fetcher"
 	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/fetcher/fakes"
 	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/integrator"
+	resolverfakes "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/resolver/fakes"
 	h "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/testhelpers"
 )
 
@@ -30,6 +40,49 @@ const (
 	ctlyInterval = "10ms"
 )
 
+var backoff = aivenapi.Backoff{
+	InitialInterval: 10 * time.Millisecond,
+	MaxInterval:     50 * time.Millisecond,
+	Exponent:        2,
+	MaxRetries:      2,
+}
+
+// callCounter counts requests itself, because httpmock.GetCallCountInfo
+// reads its counts without holding its lock
+type callCounter struct {
+	mu     sync.Mutex
+	next   http.RoundTripper
+	counts map[string]int
+}
+
+func (c *callCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.counts[req.Method+" "+req.URL.String()]++
+	c.mu.Unlock()
+
+	return c.next.RoundTrip(req)
+}
+
+func (c *callCounter) Info() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := make(map[string]int, len(c.counts))
+	for call, count := range c.counts {
+		info[call] = count
+	}
+	return info
+}
+
+func (c *callCounter) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counts = make(map[string]int)
+}
+
+var calls = &callCounter{counts: make(map[string]int)}
+
 var _ = Describe("Integrator", func() {
 	var (
 		i integrator.Integrator
@@ -37,12 +90,19 @@ var _ = Describe("Integrator", func() {
 
 		logger lager.Logger
 
-		integratorCreateServiceIntegrationErrorsTotal float64
-		integratorCreateServiceIntegrationsTotal      float64
+		integratorCreateServiceIntegrationErrors4xxTotal       float64
+		integratorCreateServiceIntegrationErrors5xxTotal       float64
+		integratorCreateServiceIntegrationErrorsCancelledTotal float64
+		aivenAPIRetries4xxTotal                                float64
+		integratorCreateServiceIntegrationsTotal               float64
+		integratorServicesSkippedUnsupportedTotal              float64
+		integratorServicesSkippedDeniedTotal                   float64
 	)
 
 	BeforeSuite(func() {
 		httpmock.Activate()
+		calls.next = httpmock.DefaultTransport
+		http.DefaultTransport = calls
 	})
 
 	AfterSuite(func() {
@@ -53,14 +113,18 @@ var _ = Describe("Integrator", func() {
 		var err error
 
 		httpmock.Reset()
+		calls.Reset()
 
 		logger = lager.NewLogger("integrator-test")
 		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
 
-		f = fakes.NewFakeFetcher()
+		f = fakes.NewFakeFetcher(project)
 
 		i, err = integrator.NewIntegrator(
-			project, token, endpoint,
+			project, token, endpoint, backoff,
+			integrator.NewServiceTypes(nil, []string{"kafka"}),
+			integrator.Reconcile{},
+			false,
 			f,
 			logger,
 		)
@@ -69,11 +133,26 @@ var _ = Describe("Integrator", func() {
 		i.SetInterval(100 * time.Millisecond) // We want fast tests
 
 		By("setting the metric values before each test")
-		integratorCreateServiceIntegrationErrorsTotal = h.CurrentMetricValue(
-			integrator.IntegratorCreateServiceIntegrationErrorsTotal,
+		integratorCreateServiceIntegrationErrors4xxTotal = h.CurrentMetricValue(
+			integrator.IntegratorCreateServiceIntegrationErrorsTotal.WithLabelValues(project, "4xx"),
+		)
+		integratorCreateServiceIntegrationErrors5xxTotal = h.CurrentMetricValue(
+			integrator.IntegratorCreateServiceIntegrationErrorsTotal.WithLabelValues(project, "5xx"),
+		)
+		integratorCreateServiceIntegrationErrorsCancelledTotal = h.CurrentMetricValue(
+			integrator.IntegratorCreateServiceIntegrationErrorsTotal.WithLabelValues(project, "cancelled"),
+		)
+		aivenAPIRetries4xxTotal = h.CurrentMetricValue(
+			aivenapi.AivenAPIRetriesTotal.WithLabelValues("4xx"),
 		)
 		integratorCreateServiceIntegrationsTotal = h.CurrentMetricValue(
-			integrator.IntegratorCreateServiceIntegrationsTotal,
+			integrator.IntegratorCreateServiceIntegrationsTotal.WithLabelValues(project),
+		)
+		integratorServicesSkippedUnsupportedTotal = h.CurrentMetricValue(
+			integrator.IntegratorServicesSkippedTotal.WithLabelValues(project, "grafana", "unsupported"),
+		)
+		integratorServicesSkippedDeniedTotal = h.CurrentMetricValue(
+			integrator.IntegratorServicesSkippedTotal.WithLabelValues(project, "kafka", "denied"),
 		)
 	})
 
@@ -102,7 +181,7 @@ var _ = Describe("Integrator", func() {
 		})
 
 		By("starting")
-		i.Start()
+		i.Start(context.Background())
 
 		By("polling for it to create the service integration")
 		Eventually(httpmock.GetTotalCallCount).Should(Equal(1))
@@ -156,16 +235,16 @@ var _ = Describe("Integrator", func() {
 		Consistently(httpmock.GetTotalCallCount, ctlyTimeout, ctlyInterval).Should(Equal(2))
 
 		By("checking the metrics")
-		Expect(integrator.IntegratorCreateServiceIntegrationsTotal).To(
+		Expect(integrator.IntegratorCreateServiceIntegrationsTotal.WithLabelValues(project)).To(
 			h.MetricIncrementedBy(integratorCreateServiceIntegrationsTotal, ">=", 2),
 		)
-		Expect(integrator.IntegratorCreateServiceIntegrationErrorsTotal).To(
-			h.MetricIncrementedBy(integratorCreateServiceIntegrationErrorsTotal, "==", 0),
+		Expect(integrator.IntegratorCreateServiceIntegrationErrorsTotal.WithLabelValues(project, "4xx")).To(
+			h.MetricIncrementedBy(integratorCreateServiceIntegrationErrors4xxTotal, "==", 0),
 		)
 	})
 
 	It("should be resilient to errors", func() {
-		creations := 0
+		var creations int32
 
 		httpmock.RegisterResponder(
 			"POST",
@@ -180,7 +259,7 @@ var _ = Describe("Integrator", func() {
 						"message":             "Completed",
 						"service_integration": aiven.ServiceIntegration{},
 					})
-					creations++
+					atomic.AddInt32(&creations, 1)
 				default:
 					resp = httpmock.NewStringResponse(404, "")
 				}
@@ -198,18 +277,18 @@ var _ = Describe("Integrator", func() {
 		})
 
 		By("starting")
-		i.Start()
+		i.Start(context.Background())
 
 		By("polling for it to create the service integration after some errors")
-		Eventually(func() int { return creations }, evTimeout, evInterval).Should(Equal(1))
+		Eventually(func() int32 { return atomic.LoadInt32(&creations) }, evTimeout, evInterval).Should(Equal(int32(1)))
 		Expect(httpmock.GetTotalCallCount()).To(BeNumerically(">=", 5))
 
 		By("checking the metrics")
-		Expect(integrator.IntegratorCreateServiceIntegrationsTotal).To(
+		Expect(integrator.IntegratorCreateServiceIntegrationsTotal.WithLabelValues(project)).To(
 			h.MetricIncrementedBy(integratorCreateServiceIntegrationsTotal, ">=", 1),
 		)
-		Expect(integrator.IntegratorCreateServiceIntegrationErrorsTotal).To(
-			h.MetricIncrementedBy(integratorCreateServiceIntegrationErrorsTotal, ">=", 1),
+		Expect(integrator.IntegratorCreateServiceIntegrationErrorsTotal.WithLabelValues(project, "4xx")).To(
+			h.MetricIncrementedBy(integratorCreateServiceIntegrationErrors4xxTotal, ">=", 1),
 		)
 	})
 
@@ -227,23 +306,752 @@ var _ = Describe("Integrator", func() {
 		f.ShouldReturn([]aiven.Service{
 			aiven.Service{
 				Name:         "a-service",
-				Type:         "influxdb",
+				Type:         "grafana",
+				Integrations: []*aiven.ServiceIntegration{},
+			},
+			aiven.Service{
+				Name:         "another-service",
+				Type:         "kafka",
 				Integrations: []*aiven.ServiceIntegration{},
 			},
 		})
 
 		By("starting")
-		i.Start()
+		i.Start(context.Background())
 
 		By("polling for it to do nothing for ineligible services")
 		Consistently(httpmock.GetTotalCallCount, ctlyTimeout, ctlyInterval).Should(Equal(0))
 
 		By("checking the metrics")
-		Expect(integrator.IntegratorCreateServiceIntegrationsTotal).To(
+		Expect(integrator.IntegratorCreateServiceIntegrationsTotal.WithLabelValues(project)).To(
 			h.MetricIncrementedBy(integratorCreateServiceIntegrationsTotal, "==", 0),
 		)
-		Expect(integrator.IntegratorCreateServiceIntegrationErrorsTotal).To(
-			h.MetricIncrementedBy(integratorCreateServiceIntegrationErrorsTotal, "==", 0),
+		Expect(integrator.IntegratorCreateServiceIntegrationErrorsTotal.WithLabelValues(project, "4xx")).To(
+			h.MetricIncrementedBy(integratorCreateServiceIntegrationErrors4xxTotal, "==", 0),
+		)
+		Expect(integrator.IntegratorServicesSkippedTotal.WithLabelValues(project, "grafana", "unsupported")).To(
+			h.MetricIncrementedBy(integratorServicesSkippedUnsupportedTotal, ">=", 1),
+		)
+		Expect(integrator.IntegratorServicesSkippedTotal.WithLabelValues(project, "kafka", "denied")).To(
+			h.MetricIncrementedBy(integratorServicesSkippedDeniedTotal, ">=", 1),
+		)
+	})
+
+	It("should create service integrations for every supported service type", func() {
+		httpmock.RegisterResponder(
+			"POST",
+			fmt.Sprintf("https://api.aiven.io/v1/project/%s/integration", project),
+			httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+				"errors":              []string{},
+				"message":             "Completed",
+				"service_integration": aiven.ServiceIntegration{},
+			}),
+		)
+
+		f.ShouldReturn([]aiven.Service{
+			aiven.Service{
+				Name:         "a-postgres",
+				Type:         "pg",
+				Integrations: []*aiven.ServiceIntegration{},
+			},
+			aiven.Service{
+				Name:         "an-influxdb",
+				Type:         "influxdb",
+				Integrations: []*aiven.ServiceIntegration{},
+			},
+		})
+
+		By("starting")
+		i.Start(context.Background())
+
+		By("polling for it to create both service integrations")
+		Eventually(httpmock.GetTotalCallCount, evTimeout, evInterval).Should(BeNumerically(">=", 2))
+	})
+
+	It("should integrate as soon as the services change", func() {
+		httpmock.RegisterResponder(
+			"POST",
+			fmt.Sprintf("https://api.aiven.io/v1/project/%s/integration", project),
+			httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+				"errors":              []string{},
+				"message":             "Completed",
+				"service_integration": aiven.ServiceIntegration{},
+			}),
+		)
+
+		i.SetInterval(time.Hour)
+
+		By("starting")
+		i.Start(context.Background())
+
+		By("changing the services")
+		f.ShouldReturn([]aiven.Service{
+			aiven.Service{
+				Name:         "a-service",
+				Type:         "pg",
+				Integrations: []*aiven.ServiceIntegration{},
+			},
+		})
+
+		By("polling for it to create the service integration without waiting for the interval")
+		Eventually(httpmock.GetTotalCallCount, evTimeout, evInterval).Should(Equal(1))
+		Consistently(httpmock.GetTotalCallCount, ctlyTimeout, ctlyInterval).Should(Equal(1))
+	})
+
+	It("should cancel an in-flight integration when it is stopped", func() {
+		blocked := make(chan struct{}, 1)
+
+		httpmock.RegisterResponder(
+			"POST",
+			fmt.Sprintf("https://api.aiven.io/v1/project/%s/integration", project),
+			func(req *http.Request) (*http.Response, error) {
+				blocked <- struct{}{}
+				<-req.Context().Done()
+				return nil, req.Context().Err()
+			},
+		)
+
+		f.ShouldReturn([]aiven.Service{
+			aiven.Service{
+				Name:         "a-service",
+				Type:         "pg",
+				Integrations: []*aiven.ServiceIntegration{},
+			},
+			aiven.Service{
+				Name:         "another-service",
+				Type:         "pg",
+				Integrations: []*aiven.ServiceIntegration{},
+			},
+		})
+
+		By("starting")
+		i.Start(context.Background())
+
+		By("waiting for a call which does not return")
+		Eventually(blocked, evTimeout, evInterval).Should(Receive())
+
+		By("stopping, which cancels the call")
+		stopped := make(chan struct{})
+		go func() {
+			i.Stop()
+			close(stopped)
+		}()
+		Eventually(stopped, evTimeout, evInterval).Should(BeClosed())
+
+		By("checking the other service was not integrated after cancelling")
+		Expect(httpmock.GetTotalCallCount()).To(Equal(1))
+		Expect(integrator.IntegratorCreateServiceIntegrationErrorsTotal.WithLabelValues(project, "cancelled")).To(
+			h.MetricIncrementedBy(integratorCreateServiceIntegrationErrorsCancelledTotal, "==", 1),
+		)
+
+		By("stopping again")
+		i.Stop()
+	})
+
+	It("should retry creating service integrations when rate limited", func() {
+		httpmock.RegisterResponder(
+			"POST",
+			fmt.Sprintf("https://api.aiven.io/v1/project/%s/integration", project),
+			func(req *http.Request) (*http.Response, error) {
+				if httpmock.GetTotalCallCount() == 1 {
+					return httpmock.NewStringResponse(429, ""), nil
+				}
+
+				return httpmock.NewJsonResponse(200, map[string]interface{}{
+					"errors":              []string{},
+					"message":             "Completed",
+					"service_integration": aiven.ServiceIntegration{},
+				})
+			},
+		)
+
+		i.SetInterval(time.Hour)
+
+		f.ShouldReturn([]aiven.Service{
+			aiven.Service{
+				Name:         "a-service",
+				Type:         "pg",
+				Integrations: []*aiven.ServiceIntegration{},
+			},
+		})
+
+		By("starting")
+		i.Start(context.Background())
+
+		By("polling for it to create the service integration after the retry")
+		Eventually(httpmock.GetTotalCallCount, evTimeout, evInterval).Should(Equal(2))
+		Consistently(httpmock.GetTotalCallCount, ctlyTimeout, ctlyInterval).Should(Equal(2))
+
+		By("checking the metrics")
+		Expect(aivenapi.AivenAPIRetriesTotal.WithLabelValues("4xx")).To(
+			h.MetricIncrementedBy(aivenAPIRetries4xxTotal, "==", 1),
+		)
+		Expect(integrator.IntegratorCreateServiceIntegrationErrorsTotal.WithLabelValues(project, "4xx")).To(
+			h.MetricIncrementedBy(integratorCreateServiceIntegrationErrors4xxTotal, "==", 0),
+		)
+	})
+
+	It("should not retry creating service integrations when Aiven fails", func() {
+		httpmock.RegisterResponder(
+			"POST",
+			fmt.Sprintf("https://api.aiven.io/v1/project/%s/integration", project),
+			httpmock.NewStringResponder(500, "Internal Server Error"),
 		)
+
+		i.SetInterval(time.Hour)
+
+		f.ShouldReturn([]aiven.Service{
+			aiven.Service{
+				Name:         "a-service",
+				Type:         "pg",
+				Integrations: []*aiven.ServiceIntegration{},
+			},
+		})
+
+		By("starting")
+		i.Start(context.Background())
+
+		By("checking it only tried once, because Aiven may have created it")
+		Eventually(httpmock.GetTotalCallCount, evTimeout, evInterval).Should(Equal(1))
+		Consistently(httpmock.GetTotalCallCount, ctlyTimeout, ctlyInterval).Should(Equal(1))
+
+		By("checking the metrics")
+		Expect(integrator.IntegratorCreateServiceIntegrationErrorsTotal.WithLabelValues(project, "5xx")).To(
+			h.MetricIncrementedBy(integratorCreateServiceIntegrationErrors5xxTotal, "==", 1),
+		)
+	})
+
+	It("should not create an integration again before it has been fetched", func() {
+		httpmock.RegisterResponder(
+			"POST",
+			fmt.Sprintf("https://api.aiven.io/v1/project/%s/integration", project),
+			httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+				"errors":              []string{},
+				"message":             "Completed",
+				"service_integration": aiven.ServiceIntegration{},
+			}),
+		)
+
+		f.ShouldReturn([]aiven.Service{
+			aiven.Service{
+				Name:         "a-service",
+				Type:         "pg",
+				Integrations: []*aiven.ServiceIntegration{},
+			},
+		})
+
+		By("starting")
+		i.Start(context.Background())
+
+		By("polling for it to create the service integration once, while the services are unchanged")
+		Eventually(httpmock.GetTotalCallCount, evTimeout, evInterval).Should(Equal(1))
+		Consistently(httpmock.GetTotalCallCount, ctlyTimeout, ctlyInterval).Should(Equal(1))
+
+		By("checking it asked the fetcher to fetch the new integration")
+		Expect(f.Refetches()).To(Equal(1))
+	})
+
+	Context("when the fetcher and discoverer are running", func() {
+		var (
+			realFetcher fetcher.Fetcher
+			d           discoverer.Discoverer
+		)
+
+		BeforeEach(func() {
+			var err error
+
+			realFetcher, err = fetcher.NewFetcher(project, token, backoff, logger)
+			Expect(err).NotTo(HaveOccurred())
+
+			i, err = integrator.NewIntegrator(
+				project, token, endpoint, backoff,
+				integrator.NewServiceTypes(nil, nil),
+				integrator.Reconcile{},
+				false,
+				realFetcher,
+				logger,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			serviceFilter, err := discoverer.NewServiceFilter(nil, "", "", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			r := resolverfakes.NewFakeResolver()
+			r.ShouldReturnIPs([]net.IP{net.IPv4(1, 2, 3, 4)})
+
+			d, err = discoverer.NewDiscoverer(
+				"",
+				[]fetcher.Fetcher{realFetcher}, r,
+				serviceFilter,
+				discoverer.ScrapeConfigs{},
+				discoverer.LabelMappings{},
+				time.Minute,
+				logger,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			By("only polling much less often than the test waits")
+			realFetcher.SetInterval(time.Hour)
+			i.SetInterval(time.Hour)
+			d.SetInterval(time.Hour)
+		})
+
+		AfterEach(func() {
+			d.Stop()
+			realFetcher.Stop()
+		})
+
+		It("should discover a new service as soon as it is integrated", func() {
+			integrated := make(chan struct{})
+
+			httpmock.RegisterResponder(
+				"GET",
+				fmt.Sprintf("https://api.aiven.io/v1/project/%s/service", project),
+				func(req *http.Request) (*http.Response, error) {
+					service := aiven.Service{
+						Name:         "a-service",
+						Type:         "pg",
+						URIParams:    map[string]string{"host": "a-service.aivencloud.com"},
+						Integrations: []*aiven.ServiceIntegration{},
+					}
+
+					select {
+					case <-integrated:
+						service.Integrations = []*aiven.ServiceIntegration{
+							&aiven.ServiceIntegration{IntegrationType: "prometheus"},
+						}
+					default:
+					}
+
+					return httpmock.NewJsonResponse(200, map[string]interface{}{
+						"errors":   []string{},
+						"message":  "Completed",
+						"services": []aiven.Service{service},
+					})
+				},
+			)
+			httpmock.RegisterResponder(
+				"POST",
+				fmt.Sprintf("https://api.aiven.io/v1/project/%s/integration", project),
+				func(req *http.Request) (*http.Response, error) {
+					close(integrated)
+
+					return httpmock.NewJsonResponse(200, map[string]interface{}{
+						"errors":              []string{},
+						"message":             "Completed",
+						"service_integration": aiven.ServiceIntegration{},
+					})
+				},
+			)
+
+			By("starting")
+			realFetcher.Start(context.Background())
+			i.Start(context.Background())
+			d.Start(context.Background())
+
+			By("polling until the service is discovered, without waiting for any interval")
+			Eventually(d.Targets, evTimeout, evInterval).Should(HaveLen(1))
+			Expect(d.Targets()[0].Labels.ServiceName).To(Equal("a-service"))
+
+			By("checking it was integrated once, and fetched again once it was")
+			Expect(calls.Info()[fmt.Sprintf(
+				"POST https://api.aiven.io/v1/project/%s/integration", project,
+			)]).To(Equal(1))
+			Expect(calls.Info()[fmt.Sprintf(
+				"GET https://api.aiven.io/v1/project/%s/service", project,
+			)]).To(Equal(2))
+		})
+	})
+
+	Context("when dry running", func() {
+		var (
+			integratorDryRunCreateServiceIntegrationsTotal float64
+		)
+
+		BeforeEach(func() {
+			var err error
+
+			i, err = integrator.NewIntegrator(
+				project, token, endpoint, backoff,
+				integrator.NewServiceTypes(nil, nil),
+				integrator.Reconcile{},
+				true,
+				f,
+				logger,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			i.SetInterval(100 * time.Millisecond) // We want fast tests
+
+			integratorDryRunCreateServiceIntegrationsTotal = h.CurrentMetricValue(
+				integrator.IntegratorDryRunCreateServiceIntegrationsTotal.WithLabelValues(project),
+			)
+		})
+
+		It("should plan service integrations without creating them", func() {
+			f.ShouldReturn([]aiven.Service{
+				aiven.Service{
+					Name:         "a-service",
+					Type:         "pg",
+					Integrations: []*aiven.ServiceIntegration{},
+				},
+			})
+
+			By("starting")
+			i.Start(context.Background())
+
+			By("polling for it to plan the service integration")
+			serviceName, endpointID := "a-service", endpoint
+			Eventually(i.PlannedActions, evTimeout, evInterval).Should(Equal([]integrator.PlannedAction{
+				integrator.PlannedAction{
+					Project: project,
+					Service: "a-service",
+					Action:  "create",
+					Request: &aiven.CreateServiceIntegrationRequest{
+						DestinationEndpointID: &endpointID,
+						SourceService:         &serviceName,
+						IntegrationType:       "prometheus",
+					},
+				},
+			}))
+
+			By("polling for it to not call Aiven")
+			Consistently(httpmock.GetTotalCallCount, ctlyTimeout, ctlyInterval).Should(Equal(0))
+
+			By("checking the metrics")
+			Expect(integrator.IntegratorDryRunCreateServiceIntegrationsTotal.WithLabelValues(project)).To(
+				h.MetricIncrementedBy(integratorDryRunCreateServiceIntegrationsTotal, ">=", 1),
+			)
+			Expect(integrator.IntegratorCreateServiceIntegrationsTotal.WithLabelValues(project)).To(
+				h.MetricIncrementedBy(integratorCreateServiceIntegrationsTotal, "==", 0),
+			)
+
+			By("serving the planned actions")
+			recorder := httptest.NewRecorder()
+			integrator.NewPlannedActionsHandler([]integrator.Integrator{i}).ServeHTTP(
+				recorder, httptest.NewRequest("GET", "/debug/planned-actions", nil),
+			)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(MatchJSON(`[{
+				"project": "my-aiven-project",
+				"service": "a-service",
+				"action": "create",
+				"request": {
+					"dest_endpoint_id": "my-aiven-prometheus-endpoint-id",
+					"source_service": "a-service",
+					"integration_type": "prometheus"
+				}
+			}]`))
+		})
+	})
+
+	Context("when reconciling", func() {
+		var (
+			integrationsURL = func(service string) string {
+				return fmt.Sprintf(
+					"https://api.aiven.io/v1/project/%s/service/%s/integration",
+					project, service,
+				)
+			}
+			integrationURL = func(id string) string {
+				return fmt.Sprintf(
+					"https://api.aiven.io/v1/project/%s/integration/%s",
+					project, id,
+				)
+			}
+			prometheusIntegration = func(id string, service string, endpointID string) *aiven.ServiceIntegration {
+				return &aiven.ServiceIntegration{
+					IntegrationType:       "prometheus",
+					ServiceIntegrationID:  id,
+					SourceService:         &service,
+					DestinationEndpointID: &endpointID,
+				}
+			}
+
+			endpointID     = endpoint
+			anotherService = "another-service"
+			deniedService  = "a-denied-service"
+
+			integratorReconcileMovesTotal float64
+		)
+
+		reconcileWith := func(reconcile integrator.Reconcile) {
+			var err error
+
+			i, err = integrator.NewIntegrator(
+				project, token, endpoint, backoff,
+				integrator.NewServiceTypes(nil, []string{"kafka"}),
+				reconcile,
+				false,
+				f,
+				logger,
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			i.SetInterval(100 * time.Millisecond) // We want fast tests
+
+			integratorReconcileMovesTotal = h.CurrentMetricValue(
+				integrator.IntegratorReconcileActionsTotal.WithLabelValues(
+					project, "move", fmt.Sprintf("%t", reconcile.DryRun),
+				),
+			)
+		}
+
+		BeforeEach(func() {
+			httpmock.RegisterResponder(
+				"GET", integrationsURL("a-service"),
+				httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+					"errors":  []string{},
+					"message": "Completed",
+					"service_integrations": []*aiven.ServiceIntegration{
+						prometheusIntegration("id-1", "a-service", "another-endpoint"),
+						prometheusIntegration("id-2", "a-service", endpoint),
+						prometheusIntegration("id-3", "a-service", endpoint),
+						&aiven.ServiceIntegration{
+							IntegrationType:      "logs",
+							ServiceIntegrationID: "id-4",
+						},
+					},
+				}),
+			)
+			httpmock.RegisterResponder(
+				"GET", integrationsURL("another-service"),
+				httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+					"errors":  []string{},
+					"message": "Completed",
+					"service_integrations": []*aiven.ServiceIntegration{
+						prometheusIntegration("id-5", "another-service", "another-endpoint"),
+					},
+				}),
+			)
+			httpmock.RegisterResponder(
+				"GET", integrationsURL("a-denied-service"),
+				httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+					"errors":  []string{},
+					"message": "Completed",
+					"service_integrations": []*aiven.ServiceIntegration{
+						prometheusIntegration("id-6", "a-denied-service", endpoint),
+						prometheusIntegration("id-7", "a-denied-service", "another-endpoint"),
+					},
+				}),
+			)
+			httpmock.RegisterResponder(
+				"POST",
+				fmt.Sprintf("https://api.aiven.io/v1/project/%s/integration", project),
+				httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+					"errors":              []string{},
+					"message":             "Completed",
+					"service_integration": aiven.ServiceIntegration{},
+				}),
+			)
+			httpmock.RegisterResponder(
+				"GET", integrationsURL("an-unsupported-service"),
+				httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+					"errors":  []string{},
+					"message": "Completed",
+					"service_integrations": []*aiven.ServiceIntegration{
+						prometheusIntegration("id-8", "an-unsupported-service", endpoint),
+					},
+				}),
+			)
+			for _, id := range []string{"id-1", "id-2", "id-3", "id-4", "id-5", "id-6", "id-7", "id-8"} {
+				httpmock.RegisterResponder(
+					"DELETE", integrationURL(id),
+					httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+						"errors":  []string{},
+						"message": "Completed",
+					}),
+				)
+			}
+
+			f.ShouldReturn([]aiven.Service{
+				aiven.Service{
+					Name: "a-service",
+					Type: "pg",
+					Integrations: []*aiven.ServiceIntegration{
+						&aiven.ServiceIntegration{IntegrationType: "prometheus"},
+					},
+				},
+				aiven.Service{
+					Name: "another-service",
+					Type: "pg",
+					Integrations: []*aiven.ServiceIntegration{
+						&aiven.ServiceIntegration{IntegrationType: "prometheus"},
+					},
+				},
+				aiven.Service{
+					Name: "a-denied-service",
+					Type: "kafka",
+					Integrations: []*aiven.ServiceIntegration{
+						&aiven.ServiceIntegration{IntegrationType: "prometheus"},
+					},
+				},
+				aiven.Service{
+					Name: "an-unsupported-service",
+					Type: "grafana",
+					Integrations: []*aiven.ServiceIntegration{
+						&aiven.ServiceIntegration{IntegrationType: "prometheus"},
+					},
+				},
+			})
+		})
+
+		It("should move integrations to the endpoint and remove duplicates", func() {
+			reconcileWith(integrator.Reconcile{Enabled: true})
+
+			By("starting")
+			i.Start(context.Background())
+
+			By("polling for it to remove the duplicates")
+			Eventually(func() int {
+				return calls.Info()["DELETE "+integrationURL("id-1")]
+			}, evTimeout, evInterval).Should(BeNumerically(">=", 1))
+			Eventually(func() int {
+				return calls.Info()["DELETE "+integrationURL("id-3")]
+			}, evTimeout, evInterval).Should(BeNumerically(">=", 1))
+
+			By("polling for it to move the integration")
+			Eventually(func() int {
+				return calls.Info()["DELETE "+integrationURL("id-5")]
+			}, evTimeout, evInterval).Should(BeNumerically(">=", 1))
+			Expect(calls.Info()[fmt.Sprintf(
+				"POST https://api.aiven.io/v1/project/%s/integration", project,
+			)]).To(BeNumerically(">=", 1))
+
+			By("checking it kept the integration which points at the endpoint")
+			Expect(calls.Info()["DELETE "+integrationURL("id-2")]).To(Equal(0))
+			Expect(calls.Info()["DELETE "+integrationURL("id-4")]).To(Equal(0))
+
+			By("checking it kept the integrations of the denied service")
+			Consistently(func() int {
+				return calls.Info()["DELETE "+integrationURL("id-6")]
+			}, ctlyTimeout, ctlyInterval).Should(Equal(0))
+			Expect(calls.Info()["DELETE "+integrationURL("id-7")]).To(Equal(0))
+
+			By("checking the metrics")
+			Expect(integrator.IntegratorReconcileActionsTotal.WithLabelValues(project, "move", "false")).To(
+				h.MetricIncrementedBy(integratorReconcileMovesTotal, ">=", 1),
+			)
+		})
+
+		It("should remove the integrations of denied service types when configured", func() {
+			reconcileWith(integrator.Reconcile{RemoveDenied: true})
+
+			By("starting")
+			i.Start(context.Background())
+
+			By("polling for it to remove the integration of the denied service")
+			Eventually(func() int {
+				return calls.Info()["DELETE "+integrationURL("id-6")]
+			}, evTimeout, evInterval).Should(BeNumerically(">=", 1))
+
+			By("checking it kept the integration of the denied service with another endpoint")
+			Expect(calls.Info()["DELETE "+integrationURL("id-7")]).To(Equal(0))
+
+			By("checking it kept the integration of the unsupported service")
+			Consistently(func() int {
+				return calls.Info()["DELETE "+integrationURL("id-8")]
+			}, ctlyTimeout, ctlyInterval).Should(Equal(0))
+
+			By("checking it did not move integrations or remove duplicates")
+			Expect(calls.Info()["DELETE "+integrationURL("id-1")]).To(Equal(0))
+			Expect(calls.Info()["DELETE "+integrationURL("id-3")]).To(Equal(0))
+			Expect(calls.Info()["DELETE "+integrationURL("id-5")]).To(Equal(0))
+			Expect(calls.Info()[fmt.Sprintf(
+				"POST https://api.aiven.io/v1/project/%s/integration", project,
+			)]).To(Equal(0))
+		})
+
+		It("should only log and count the changes in a dry run", func() {
+			reconcileWith(integrator.Reconcile{Enabled: true, RemoveDenied: true, DryRun: true})
+
+			By("starting")
+			i.Start(context.Background())
+
+			By("polling for it to list the integrations")
+			Eventually(func() int {
+				return calls.Info()["GET "+integrationsURL("another-service")]
+			}, evTimeout, evInterval).Should(BeNumerically(">=", 1))
+
+			By("checking the metrics")
+			Eventually(func() float64 {
+				return h.CurrentMetricValue(
+					integrator.IntegratorReconcileActionsTotal.WithLabelValues(project, "move", "true"),
+				)
+			}, evTimeout, evInterval).Should(BeNumerically(">=", integratorReconcileMovesTotal+1))
+
+			By("polling for it to change nothing")
+			Consistently(func() int {
+				changes := 0
+				for call, count := range calls.Info() {
+					if !strings.HasPrefix(call, "GET ") {
+						changes += count
+					}
+				}
+				return changes
+			}, ctlyTimeout, ctlyInterval).Should(Equal(0))
+
+			By("checking the planned actions")
+			Expect(i.PlannedActions()).To(ContainElement(integrator.PlannedAction{
+				Project:       project,
+				Service:       "another-service",
+				Action:        "move",
+				IntegrationID: "id-5",
+				Request: &aiven.CreateServiceIntegrationRequest{
+					DestinationEndpointID: &endpointID,
+					SourceService:         &anotherService,
+					IntegrationType:       "prometheus",
+				},
+			}))
+			Expect(i.PlannedActions()).To(ContainElement(integrator.PlannedAction{
+				Project:       project,
+				Service:       "a-service",
+				Action:        "remove-duplicate",
+				IntegrationID: "id-3",
+			}))
+			Expect(i.PlannedActions()).To(ContainElement(integrator.PlannedAction{
+				Project:       project,
+				Service:       deniedService,
+				Action:        "remove-denied",
+				IntegrationID: "id-6",
+			}))
+			Expect(i.PlannedActions()).NotTo(ContainElement(integrator.PlannedAction{
+				Project:       project,
+				Service:       deniedService,
+				Action:        "remove-denied",
+				IntegrationID: "id-7",
+			}))
+		})
+
+		It("should only reconcile when the services change or the reconcile interval passes", func() {
+			reconcileWith(integrator.Reconcile{Enabled: true, DryRun: true})
+			i.SetReconcileInterval(time.Hour)
+
+			listCalls := func() int {
+				return calls.Info()["GET "+integrationsURL("another-service")]
+			}
+
+			By("starting")
+			i.Start(context.Background())
+
+			By("polling for it to list the integrations once")
+			Eventually(listCalls, evTimeout, evInterval).Should(Equal(1))
+			Consistently(listCalls, ctlyTimeout, ctlyInterval).Should(Equal(1))
+
+			By("checking the planned actions are kept between reconciles")
+			Expect(i.PlannedActions()).To(ContainElement(integrator.PlannedAction{
+				Project:       project,
+				Service:       "a-service",
+				Action:        "remove-duplicate",
+				IntegrationID: "id-3",
+			}))
+
+			By("changing the services")
+			f.ShouldReturn(f.Services()[1:])
+
+			By("polling for it to list the integrations again")
+			Eventually(listCalls, evTimeout, evInterval).Should(Equal(2))
+			Consistently(listCalls, ctlyTimeout, ctlyInterval).Should(Equal(2))
+		})
 	})
 })
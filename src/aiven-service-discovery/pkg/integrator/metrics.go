@@ -5,18 +5,43 @@ import (
 )
 
 var (
-	IntegratorCreateServiceIntegrationErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	IntegratorCreateServiceIntegrationErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "integrator_create_service_integration_errors_total",
-		Help: "Counter of total number of Aiven create service integration failures",
-	})
+		Help: "Counter of total number of Aiven create service integration failures, by the HTTP status class of the failure",
+	}, []string{"project", "status_class"})
 
-	IntegratorCreateServiceIntegrationsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	IntegratorCreateServiceIntegrationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "integrator_create_service_integrations_total",
 		Help: "Counter of total number of calls to create a service integration",
-	})
+	}, []string{"project"})
+
+	IntegratorDryRunCreateServiceIntegrationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "integrator_dry_run_create_service_integrations_total",
+		Help: "Counter of total number of service integrations which would have been created if not in a dry run",
+	}, []string{"project"})
+
+	IntegratorServicesSkippedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "integrator_services_skipped_total",
+		Help: "Counter of total number of services without a Prometheus integration which were not integrated because of their service type",
+	}, []string{"project", "service_type", "reason"})
+
+	IntegratorReconcileActionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "integrator_reconcile_actions_total",
+		Help: "Counter of total number of changes made, or which would be made in a dry run, to existing Prometheus integrations",
+	}, []string{"project", "action", "dry_run"})
+
+	IntegratorReconcileErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "integrator_reconcile_errors_total",
+		Help: "Counter of total number of Aiven failures when reconciling Prometheus integrations, by the HTTP status class of the failure",
+	}, []string{"project", "status_class"})
 )
 
 func initMetrics() {
 	prometheus.MustRegister(IntegratorCreateServiceIntegrationErrorsTotal)
 	prometheus.MustRegister(IntegratorCreateServiceIntegrationsTotal)
+	prometheus.MustRegister(IntegratorDryRunCreateServiceIntegrationsTotal)
+	prometheus.MustRegister(IntegratorServicesSkippedTotal)
+
+	prometheus.MustRegister(IntegratorReconcileActionsTotal)
+	prometheus.MustRegister(IntegratorReconcileErrorsTotal)
 }
@@ -0,0 +1,47 @@
+package integrator
+
+import (
+	"encoding/json"
+	"net/http"
+
+	aiven "github.com/aiven/aiven-go-client"
+)
+
+const (
+	plannedActionCreate = "create"
+)
+
+// PlannedAction is a change to the Prometheus integrations of a service which
+// a dry run would have made
+type PlannedAction struct {
+	Project string `json:"project"`
+	Service string `json:"service"`
+	Action  string `json:"action"`
+
+	// IntegrationID is the existing integration which would be changed
+	IntegrationID string `json:"integration_id,omitempty"`
+
+	// Request is the integration which would be created
+	Request *aiven.CreateServiceIntegrationRequest `json:"request,omitempty"`
+}
+
+// NewPlannedActionsHandler serves, as JSON, the actions which the integrators
+// planned during their most recent dry run
+func NewPlannedActionsHandler(integrators []Integrator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		actions := make([]PlannedAction, 0)
+		for _, integrator := range integrators {
+			actions = append(actions, integrator.PlannedActions()...)
+		}
+
+		body, err := json.Marshal(actions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	})
+}
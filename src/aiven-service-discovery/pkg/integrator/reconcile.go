@@ -0,0 +1,245 @@
+package integrator
+
+import (
+	"context"
+	"strconv"
+
+	"code.cloudfoundry.org/lager"
+	aiven "github.com/aiven/aiven-go-client"
+
+	"github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/aivenapi"
+)
+
+const (
+	reconcileActionMove            = "move"
+	reconcileActionRemoveDuplicate = "remove-duplicate"
+	reconcileActionRemoveDenied    = "remove-denied"
+)
+
+// Reconcile chooses whether the existing Prometheus integrations of services
+// are corrected, and separately whether the integrations with the endpoint of
+// services whose type is denied are removed. When DryRun is true the
+// corrections are only logged and counted
+type Reconcile struct {
+	Enabled      bool
+	RemoveDenied bool
+	DryRun       bool
+}
+
+// reconcileService makes sure the service has exactly one Prometheus
+// integration, and that it points at the configured endpoint. Aiven cannot
+// change the destination of an integration, so an integration is moved by
+// creating a new one and removing the old one
+func (i *integrator) reconcileService(ctx context.Context, s aiven.Service) {
+	lsession := i.logger.Session(
+		"reconcile-service", lager.Data{"service": s.Name},
+	)
+	lsession.Info("begin")
+	defer lsession.Info("end")
+
+	prometheusIntegrations, ok := i.listPrometheusIntegrations(ctx, lsession, s)
+	if !ok || len(prometheusIntegrations) == 0 {
+		return
+	}
+
+	// Keep an integration which already points at the configured endpoint
+	// when there is one, so that nothing needs to be moved
+	keep := prometheusIntegrations[0]
+	for _, integration := range prometheusIntegrations {
+		if i.pointsAtEndpoint(integration) {
+			keep = integration
+			break
+		}
+	}
+
+	for _, integration := range prometheusIntegrations {
+		if integration == keep {
+			continue
+		}
+
+		i.removeIntegration(ctx, lsession, s, integration, reconcileActionRemoveDuplicate)
+	}
+
+	if !i.pointsAtEndpoint(keep) {
+		i.moveIntegration(ctx, lsession, s, keep)
+	}
+}
+
+// reconcileDeniedService removes the integrations with the configured
+// endpoint of a service whose type has been denied since it was integrated.
+// Integrations with other endpoints were not made by the integrator, so they
+// are left alone
+func (i *integrator) reconcileDeniedService(ctx context.Context, s aiven.Service) {
+	lsession := i.logger.Session(
+		"reconcile-denied-service", lager.Data{"service": s.Name},
+	)
+	lsession.Info("begin")
+	defer lsession.Info("end")
+
+	prometheusIntegrations, ok := i.listPrometheusIntegrations(ctx, lsession, s)
+	if !ok {
+		return
+	}
+
+	for _, integration := range prometheusIntegrations {
+		if !i.pointsAtEndpoint(integration) {
+			continue
+		}
+
+		i.removeIntegration(ctx, lsession, s, integration, reconcileActionRemoveDenied)
+	}
+}
+
+// listPrometheusIntegrations lists the Prometheus integrations of which the
+// service is the source, and whether they could be listed
+func (i *integrator) listPrometheusIntegrations(
+	ctx context.Context,
+	lsession lager.Logger,
+	s aiven.Service,
+) ([]*aiven.ServiceIntegration, bool) {
+	aivenClient, cancel := aivenapi.WithTimeout(ctx, i.aivenClient, aivenapi.DefaultTimeout)
+	defer cancel()
+
+	integrations, err := aivenClient.ServiceIntegrations.List(i.aivenProject, s.Name)
+	if err != nil {
+		lsession.Error("err-aiven-list-service-integrations", err)
+
+		IntegratorReconcileErrorsTotal.WithLabelValues(
+			i.aivenProject, aivenapi.StatusClass(err),
+		).Inc()
+
+		return nil, false
+	}
+
+	prometheusIntegrations := make([]*aiven.ServiceIntegration, 0)
+	for _, integration := range integrations {
+		if integration.IntegrationType != "prometheus" {
+			continue
+		}
+
+		if integration.SourceService != nil && *integration.SourceService != s.Name {
+			continue
+		}
+
+		prometheusIntegrations = append(prometheusIntegrations, integration)
+	}
+
+	return prometheusIntegrations, true
+}
+
+func (i *integrator) pointsAtEndpoint(integration *aiven.ServiceIntegration) bool {
+	return integration.DestinationEndpointID != nil &&
+		*integration.DestinationEndpointID == i.aivenPrometheusEndpointID
+}
+
+func (i *integrator) moveIntegration(
+	ctx context.Context,
+	lsession lager.Logger,
+	s aiven.Service,
+	integration *aiven.ServiceIntegration,
+) {
+	data := lager.Data{
+		"action":         reconcileActionMove,
+		"integration-id": integration.ServiceIntegrationID,
+		"endpoint-id":    integration.DestinationEndpointID,
+		"dry-run":        i.reconcile.DryRun,
+	}
+	lsession.Info("reconcile-action", data)
+
+	IntegratorReconcileActionsTotal.WithLabelValues(
+		i.aivenProject, reconcileActionMove, strconv.FormatBool(i.reconcile.DryRun),
+	).Inc()
+
+	if i.reconcile.DryRun {
+		i.planReconcile(PlannedAction{
+			Service:       s.Name,
+			Action:        reconcileActionMove,
+			IntegrationID: integration.ServiceIntegrationID,
+			Request: &aiven.CreateServiceIntegrationRequest{
+				DestinationEndpointID: &i.aivenPrometheusEndpointID,
+				SourceService:         &s.Name,
+				IntegrationType:       "prometheus",
+			},
+		})
+
+		return
+	}
+
+	aivenClient, cancel := aivenapi.WithTimeout(ctx, i.aivenClient, aivenapi.DefaultTimeout)
+	defer cancel()
+
+	_, err := aivenClient.ServiceIntegrations.Create(
+		i.aivenProject,
+		aiven.CreateServiceIntegrationRequest{
+			DestinationEndpointID: &i.aivenPrometheusEndpointID,
+			SourceService:         &s.Name,
+			IntegrationType:       "prometheus",
+		},
+	)
+	if err != nil {
+		lsession.Error("err-aiven-create-service-integration", err, data)
+
+		IntegratorReconcileErrorsTotal.WithLabelValues(
+			i.aivenProject, aivenapi.StatusClass(err),
+		).Inc()
+
+		// The old integration is only removed once the new one exists, so
+		// that the service is never left without one
+		return
+	}
+
+	err = aivenClient.ServiceIntegrations.Delete(
+		i.aivenProject, integration.ServiceIntegrationID,
+	)
+	if err != nil {
+		lsession.Error("err-aiven-delete-service-integration", err, data)
+
+		IntegratorReconcileErrorsTotal.WithLabelValues(
+			i.aivenProject, aivenapi.StatusClass(err),
+		).Inc()
+	}
+}
+
+func (i *integrator) removeIntegration(
+	ctx context.Context,
+	lsession lager.Logger,
+	s aiven.Service,
+	integration *aiven.ServiceIntegration,
+	action string,
+) {
+	data := lager.Data{
+		"action":         action,
+		"integration-id": integration.ServiceIntegrationID,
+		"endpoint-id":    integration.DestinationEndpointID,
+		"dry-run":        i.reconcile.DryRun,
+	}
+	lsession.Info("reconcile-action", data)
+
+	IntegratorReconcileActionsTotal.WithLabelValues(
+		i.aivenProject, action, strconv.FormatBool(i.reconcile.DryRun),
+	).Inc()
+
+	if i.reconcile.DryRun {
+		i.planReconcile(PlannedAction{
+			Service:       s.Name,
+			Action:        action,
+			IntegrationID: integration.ServiceIntegrationID,
+		})
+
+		return
+	}
+
+	aivenClient, cancel := aivenapi.WithTimeout(ctx, i.aivenClient, aivenapi.DefaultTimeout)
+	defer cancel()
+
+	err := aivenClient.ServiceIntegrations.Delete(
+		i.aivenProject, integration.ServiceIntegrationID,
+	)
+	if err != nil {
+		lsession.Error("err-aiven-delete-service-integration", err, data)
+
+		IntegratorReconcileErrorsTotal.WithLabelValues(
+			i.aivenProject, aivenapi.StatusClass(err),
+		).Inc()
+	}
+}
@@ -0,0 +1,67 @@
+package integrator
+
+const (
+	skipReasonDenied      = "denied"
+	skipReasonUnsupported = "unsupported"
+)
+
+// DefaultServiceTypes are the Aiven service types which support the
+// Prometheus integration, and so are integrated unless configured otherwise
+var DefaultServiceTypes = []string{
+	"cassandra",
+	"clickhouse",
+	"elasticsearch",
+	"influxdb",
+	"kafka",
+	"kafka_connect",
+	"kafka_mirrormaker",
+	"m3db",
+	"mysql",
+	"opensearch",
+	"pg",
+	"redis",
+}
+
+// ServiceTypes decides which Aiven service types are integrated with
+// Prometheus
+type ServiceTypes struct {
+	allowed map[string]bool
+	denied  map[string]bool
+}
+
+// NewServiceTypes allows the given types, or DefaultServiceTypes when allow
+// is empty, except for any denied types
+func NewServiceTypes(allow []string, deny []string) ServiceTypes {
+	if len(allow) == 0 {
+		allow = DefaultServiceTypes
+	}
+
+	t := ServiceTypes{
+		allowed: make(map[string]bool),
+		denied:  make(map[string]bool),
+	}
+
+	for _, serviceType := range allow {
+		t.allowed[serviceType] = true
+	}
+
+	for _, serviceType := range deny {
+		t.denied[serviceType] = true
+	}
+
+	return t
+}
+
+// Integrate returns whether services of the type should be integrated, and
+// when they should not, the reason why
+func (t ServiceTypes) Integrate(serviceType string) (bool, string) {
+	if t.denied[serviceType] {
+		return false, skipReasonDenied
+	}
+
+	if !t.allowed[serviceType] {
+		return false, skipReasonUnsupported
+	}
+
+	return true, ""
+}
@@ -0,0 +1,217 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	typeA    = uint16(dnsmessage.TypeA)
+	typeAAAA = uint16(dnsmessage.TypeAAAA)
+
+	maxUDPResponseSize = 4096
+)
+
+// answer is the IPs of a single DNS query, with the lowest TTL of the
+// records in the answer
+type answer struct {
+	ips []net.IP
+	ttl uint32
+}
+
+// notFoundError is returned when a server answers that the name does not
+// exist, which is not worth retrying against another server
+type notFoundError struct {
+	hostname string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("DNS lookup of %s: no such host", e.hostname)
+}
+
+// exchange sends a query to the server over UDP, and again over TCP when
+// the answer is truncated. Each is given up after the timeout, or sooner
+// when the context is done
+func exchange(
+	ctx context.Context,
+	server string,
+	hostname string,
+	qtype uint16,
+	timeout time.Duration,
+) (answer, error) {
+	fqdn := hostname
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return answer{}, err
+	}
+
+	id := uint16(rand.Uint32())
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.Type(qtype),
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+
+	packed, err := query.Pack()
+	if err != nil {
+		return answer{}, err
+	}
+
+	response, err := exchangeUDP(ctx, server, packed, timeout)
+	if err != nil {
+		return answer{}, err
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return answer{}, err
+	}
+
+	if msg.Header.Truncated {
+		response, err = exchangeTCP(ctx, server, packed, timeout)
+		if err != nil {
+			return answer{}, err
+		}
+
+		if err := msg.Unpack(response); err != nil {
+			return answer{}, err
+		}
+	}
+
+	if msg.Header.ID != id {
+		return answer{}, fmt.Errorf("DNS lookup of %s: response ID does not match query", hostname)
+	}
+
+	if len(msg.Questions) != 1 ||
+		!strings.EqualFold(msg.Questions[0].Name.String(), fqdn) ||
+		msg.Questions[0].Type != dnsmessage.Type(qtype) ||
+		msg.Questions[0].Class != dnsmessage.ClassINET {
+		return answer{}, fmt.Errorf("DNS lookup of %s: response question does not match query", hostname)
+	}
+
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return answer{}, &notFoundError{hostname: hostname}
+	default:
+		return answer{}, fmt.Errorf("DNS lookup of %s: server %s returned %s", hostname, server, msg.Header.RCode)
+	}
+
+	a := answer{ips: make([]net.IP, 0)}
+	for index, resource := range msg.Answers {
+		if index == 0 || resource.Header.TTL < a.ttl {
+			a.ttl = resource.Header.TTL
+		}
+
+		switch body := resource.Body.(type) {
+		case *dnsmessage.AResource:
+			a.ips = append(a.ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			a.ips = append(a.ips, net.IP(body.AAAA[:]))
+		}
+	}
+
+	return a, nil
+}
+
+// dial connects to the server with a deadline of the timeout or the
+// deadline of the context, whichever is sooner. The connection is closed
+// early when the context is done, and by calling the returned func
+func dial(
+	ctx context.Context,
+	network string,
+	server string,
+	timeout time.Duration,
+) (net.Conn, func(), error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	return conn, func() {
+		close(done)
+		cancel()
+		conn.Close()
+	}, nil
+}
+
+func exchangeUDP(ctx context.Context, server string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, closeConn, err := dial(ctx, "udp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer closeConn()
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, maxUDPResponseSize)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response[:n], nil
+}
+
+// exchangeTCP prefixes the query, and reads the response, with its length
+// as DNS over TCP requires
+func exchangeTCP(ctx context.Context, server string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, closeConn, err := dial(ctx, "tcp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer closeConn()
+
+	prefixed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(prefixed, uint16(len(query)))
+	copy(prefixed[2:], query)
+
+	if _, err := conn.Write(prefixed); err != nil {
+		return nil, err
+	}
+
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, length)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
@@ -1,33 +1,60 @@
 package fakes
 
 import (
+	"context"
 	"net"
+	"sync"
 )
 
 type FakeResolver struct {
-	shouldReturnIPs   []net.IP
-	shouldReturnError error
+	mutex sync.Mutex
+
+	shouldReturnIPs      []net.IP
+	shouldReturnIPsByKey map[string][]net.IP
+	shouldReturnError    error
 }
 
 func NewFakeResolver() *FakeResolver {
 	return &FakeResolver{
-		shouldReturnIPs:   make([]net.IP, 0),
-		shouldReturnError: nil,
+		shouldReturnIPs:      make([]net.IP, 0),
+		shouldReturnIPsByKey: make(map[string][]net.IP),
+		shouldReturnError:    nil,
 	}
 }
 
-func (r *FakeResolver) Resolve(hostname string) ([]net.IP, error) {
+func (r *FakeResolver) Resolve(_ context.Context, hostname string) ([]net.IP, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	if r.shouldReturnError != nil {
 		return make([]net.IP, 0), r.shouldReturnError
 	}
 
+	if ips, ok := r.shouldReturnIPsByKey[hostname]; ok {
+		return ips, nil
+	}
+
 	return r.shouldReturnIPs, nil
 }
 
 func (r *FakeResolver) ShouldReturnIPs(ips []net.IP) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	r.shouldReturnIPs = ips
 }
 
+// ShouldReturnIPsFor overrides the IPs returned for a single hostname
+func (r *FakeResolver) ShouldReturnIPsFor(hostname string, ips []net.IP) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.shouldReturnIPsByKey[hostname] = ips
+}
+
 func (r *FakeResolver) ShouldReturnError(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	r.shouldReturnError = err
 }
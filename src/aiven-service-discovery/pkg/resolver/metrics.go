@@ -14,9 +14,28 @@ var (
 		Name: "resolver_resolves_total",
 		Help: "Counter of total number of IP resolver calls",
 	})
+
+	ResolverResolveDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "resolver_resolve_duration_seconds",
+		Help:    "Histogram of the duration of IP resolver calls which were not answered from the cache",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	})
+
+	ResolverCacheHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "resolver_cache_hits_total",
+		Help: "Counter of total number of IP resolver calls answered from the cache",
+	})
+
+	ResolverQueryErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "resolver_query_errors_total",
+		Help: "Counter of total number of DNS queries to a server which failed, including those which were retried",
+	})
 )
 
 func initMetrics() {
 	prometheus.MustRegister(ResolverResolveFailuresTotal)
 	prometheus.MustRegister(ResolverResolvesTotal)
+	prometheus.MustRegister(ResolverResolveDurationSeconds)
+	prometheus.MustRegister(ResolverCacheHitsTotal)
+	prometheus.MustRegister(ResolverQueryErrorsTotal)
 }
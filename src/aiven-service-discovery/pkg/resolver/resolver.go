@@ -1,24 +1,108 @@
 package resolver
 
 import (
+	"bufio"
+	"context"
+	"fmt"
 	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 func init() {
 	initMetrics()
 }
 
+const (
+	defaultTimeout = 2 * time.Second
+
+	resolvConfPath = "/etc/resolv.conf"
+	defaultDNSPort = "53"
+	fallbackServer = "127.0.0.1:53"
+
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+	familyBoth = "both"
+)
+
 type Resolver interface {
-	Resolve(string) ([]net.IP, error)
+	// Resolve returns the IPs of the hostname, and gives up when the
+	// context is done
+	Resolve(context.Context, string) ([]net.IP, error)
 }
 
-type resolver struct{}
+type resolver struct {
+	servers []string
+	timeout time.Duration
+	retries int
+	family  string
+
+	cacheMutex sync.Mutex
+	cache      map[string]cacheEntry
+}
 
-func (r *resolver) Resolve(hostname string) ([]net.IP, error) {
-	ips, err := net.LookupIP(hostname)
+type cacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// NewResolver returns a resolver which queries the servers, or the
+// nameservers in /etc/resolv.conf when there are none, with a timeout for
+// each query and the number of retries after a failed query.
+//
+// Family is ipv4, ipv6 or both, and chooses whether A records, AAAA records
+// or both are queried. Answers are cached for their TTL
+func NewResolver(
+	servers []string,
+	timeout time.Duration,
+	retries int,
+	family string,
+) (Resolver, error) {
+	switch family {
+	case "":
+		family = familyBoth
+	case familyIPv4, familyIPv6, familyBoth:
+	default:
+		return nil, fmt.Errorf("DNS family %q must be one of ipv4, ipv6 or both", family)
+	}
+
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
 
+	if retries < 0 {
+		return nil, fmt.Errorf("DNS retries must not be negative")
+	}
+
+	if len(servers) == 0 {
+		servers = systemServers()
+	}
+
+	withPorts := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, defaultDNSPort)
+		}
+		withPorts = append(withPorts, server)
+	}
+
+	return &resolver{
+		servers: withPorts,
+		timeout: timeout,
+		retries: retries,
+		family:  family,
+
+		cache: make(map[string]cacheEntry),
+	}, nil
+}
+
+func (r *resolver) Resolve(ctx context.Context, hostname string) ([]net.IP, error) {
 	ResolverResolvesTotal.Inc()
 
+	ips, err := r.resolve(ctx, hostname)
 	if err != nil {
 		ResolverResolveFailuresTotal.Inc()
 	}
@@ -26,6 +110,191 @@ func (r *resolver) Resolve(hostname string) ([]net.IP, error) {
 	return ips, err
 }
 
-func NewResolver() Resolver {
-	return &resolver{}
+func (r *resolver) resolve(ctx context.Context, hostname string) ([]net.IP, error) {
+	if hostname == "" {
+		return make([]net.IP, 0), fmt.Errorf("DNS hostname must not be empty")
+	}
+
+	if ip := net.ParseIP(hostname); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	key := r.family + "/" + strings.ToLower(hostname)
+	if ips, ok := r.cached(key); ok {
+		ResolverCacheHitsTotal.Inc()
+		return ips, nil
+	}
+
+	start := time.Now()
+	ips, ttl, err := r.lookup(ctx, hostname)
+	ResolverResolveDurationSeconds.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		return make([]net.IP, 0), err
+	}
+
+	if ttl > 0 {
+		r.cacheMutex.Lock()
+		r.cache[key] = cacheEntry{
+			ips:     ips,
+			expires: time.Now().Add(time.Duration(ttl) * time.Second),
+		}
+		r.cacheMutex.Unlock()
+	}
+
+	return ips, nil
+}
+
+func (r *resolver) cached(key string) ([]net.IP, bool) {
+	r.cacheMutex.Lock()
+	defer r.cacheMutex.Unlock()
+
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(r.cache, key)
+		return nil, false
+	}
+
+	return entry.ips, true
+}
+
+// lookup queries the records of the family, returning the IPs along with
+// the lowest TTL of the answers which have IPs
+func (r *resolver) lookup(ctx context.Context, hostname string) ([]net.IP, uint32, error) {
+	qtypes := []uint16{typeA, typeAAAA}
+	switch r.family {
+	case familyIPv4:
+		qtypes = []uint16{typeA}
+	case familyIPv6:
+		qtypes = []uint16{typeAAAA}
+	}
+
+	var (
+		ips     []net.IP
+		ttl     uint32
+		lastErr error
+		answers int
+	)
+
+	for _, qtype := range qtypes {
+		a, err := r.query(ctx, hostname, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		answers++
+
+		// An empty answer, such as for the AAAA records of a host which only
+		// has IPv4 addresses, has no records whose TTL it could lower
+		if len(a.ips) == 0 {
+			continue
+		}
+
+		if len(ips) == 0 || a.ttl < ttl {
+			ttl = a.ttl
+		}
+
+		ips = append(ips, a.ips...)
+	}
+
+	if answers == 0 {
+		return nil, 0, lastErr
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("DNS lookup of %s returned no %s addresses", hostname, r.family)
+	}
+
+	// Only cache the answers when every query succeeded, so that a failed
+	// query for one family is retried
+	if lastErr != nil {
+		ttl = 0
+	}
+
+	sort.Slice(ips, func(i, j int) bool {
+		return ips[i].String() < ips[j].String()
+	})
+
+	return ips, ttl, nil
+}
+
+// query retries the query against each of the servers in turn, until one
+// answers or the retries are exhausted. A server which answers that the
+// name does not exist is not retried, and neither is a cancelled query
+func (r *resolver) query(ctx context.Context, hostname string, qtype uint16) (answer, error) {
+	var lastErr error
+
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return answer{}, err
+		}
+
+		server := r.servers[attempt%len(r.servers)]
+
+		a, err := exchange(ctx, server, hostname, qtype, r.timeout)
+		if err == nil {
+			return a, nil
+		}
+
+		ResolverQueryErrorsTotal.Inc()
+
+		// The connection is closed when the context is done, so the error
+		// from the exchange does not say why. The deadline of the
+		// connection can pass just before the context notices its own
+		if err := contextErr(ctx); err != nil {
+			return answer{}, err
+		}
+
+		lastErr = err
+
+		if _, ok := err.(*notFoundError); ok {
+			return answer{}, err
+		}
+	}
+
+	return answer{}, lastErr
+}
+
+// contextErr is the error of the context, or DeadlineExceeded when its
+// deadline has passed but it is not yet done
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+
+	return nil
+}
+
+// systemServers are the nameservers in /etc/resolv.conf
+func systemServers() []string {
+	servers := make([]string, 0)
+
+	file, err := os.Open(resolvConfPath)
+	if err != nil {
+		return []string{fallbackServer}
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+
+	if len(servers) == 0 {
+		return []string{fallbackServer}
+	}
+
+	return servers
 }
@@ -1,34 +1,204 @@
 package resolver_test
 
 import (
+	"context"
 	"net"
+	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"golang.org/x/net/dns/dnsmessage"
+
 	r "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/resolver"
 	h "github.com/alphagov/paas-observability-release/src/aiven-service-discovery/pkg/testhelpers"
 )
 
+// fakeDNSServer answers A and AAAA queries over UDP from its records, and
+// ignores queries while it is dropping them. While it is misanswering it
+// answers with a question other than the one it was asked
+type fakeDNSServer struct {
+	conn net.PacketConn
+
+	mutex        sync.Mutex
+	records      map[string][]net.IP
+	ttl          uint32
+	dropping     bool
+	misanswering bool
+	queries      int
+}
+
+func newFakeDNSServer() *fakeDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+
+	s := &fakeDNSServer{conn: conn, records: make(map[string][]net.IP), ttl: 60}
+	go s.serve()
+
+	return s
+}
+
+func (s *fakeDNSServer) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *fakeDNSServer) Close() {
+	s.conn.Close()
+}
+
+func (s *fakeDNSServer) Queries() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.queries
+}
+
+func (s *fakeDNSServer) SetDropping(dropping bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dropping = dropping
+}
+
+func (s *fakeDNSServer) SetRecords(name string, ips []net.IP) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records[name] = ips
+}
+
+func (s *fakeDNSServer) SetTTL(ttl uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ttl = ttl
+}
+
+func (s *fakeDNSServer) SetMisanswering(misanswering bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.misanswering = misanswering
+}
+
+func (s *fakeDNSServer) serve() {
+	buf := make([]byte, 512)
+
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil {
+			continue
+		}
+
+		s.mutex.Lock()
+		s.queries++
+		dropping := s.dropping
+		s.mutex.Unlock()
+
+		if dropping {
+			continue
+		}
+
+		response := s.answer(query)
+		packed, err := response.Pack()
+		if err != nil {
+			continue
+		}
+
+		s.conn.WriteTo(packed, addr)
+	}
+}
+
+func (s *fakeDNSServer) answer(query dnsmessage.Message) dnsmessage.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	question := query.Questions[0]
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.Header.ID,
+			Response:           true,
+			RecursionAvailable: true,
+		},
+		Questions: query.Questions,
+	}
+
+	ips, ok := s.records[question.Name.String()]
+	if !ok {
+		response.Header.RCode = dnsmessage.RCodeNameError
+		return response
+	}
+
+	if s.misanswering {
+		question.Name = dnsmessage.MustNewName("another-" + question.Name.String())
+		response.Questions = []dnsmessage.Question{question}
+	}
+
+	for _, ip := range ips {
+		header := dnsmessage.ResourceHeader{
+			Name:  question.Name,
+			Type:  question.Type,
+			Class: dnsmessage.ClassINET,
+			TTL:   s.ttl,
+		}
+
+		if ip4 := ip.To4(); ip4 != nil && question.Type == dnsmessage.TypeA {
+			var a [4]byte
+			copy(a[:], ip4)
+			response.Answers = append(response.Answers, dnsmessage.Resource{
+				Header: header, Body: &dnsmessage.AResource{A: a},
+			})
+		} else if ip.To4() == nil && question.Type == dnsmessage.TypeAAAA {
+			var aaaa [16]byte
+			copy(aaaa[:], ip.To16())
+			response.Answers = append(response.Answers, dnsmessage.Resource{
+				Header: header, Body: &dnsmessage.AAAAResource{AAAA: aaaa},
+			})
+		}
+	}
+
+	return response
+}
+
 var _ = Describe("Resolver", func() {
 	var (
+		server   *fakeDNSServer
 		resolver r.Resolver
 
 		resolvesTotal        float64
 		resolveFailuresTotal float64
+		cacheHitsTotal       float64
 	)
 
 	BeforeEach(func() {
-		resolver = r.NewResolver()
+		var err error
+
+		server = newFakeDNSServer()
+		server.SetRecords("an-instance.aivencloud.com.", []net.IP{
+			net.ParseIP("10.0.0.2"),
+			net.ParseIP("10.0.0.1"),
+			net.ParseIP("fd00::1"),
+		})
+
+		resolver, err = r.NewResolver(
+			[]string{server.Addr()}, 100*time.Millisecond, 1, "both",
+		)
+		Expect(err).NotTo(HaveOccurred())
 
 		By("setting the metric values before each test")
 		resolvesTotal = h.CurrentMetricValue(r.ResolverResolvesTotal)
 		resolveFailuresTotal = h.CurrentMetricValue(r.ResolverResolveFailuresTotal)
+		cacheHitsTotal = h.CurrentMetricValue(r.ResolverCacheHitsTotal)
+	})
+
+	AfterEach(func() {
+		server.Close()
 	})
 
 	Context("when resolving succeeds", func() {
 		It("should return the IPs and increment the total metric", func() {
-			ips, err := resolver.Resolve("127.0.0.1")
+			ips, err := resolver.Resolve(context.Background(), "127.0.0.1")
 
 			By("checking the results")
 			Expect(err).NotTo(HaveOccurred())
@@ -38,11 +208,77 @@ var _ = Describe("Resolver", func() {
 			Expect(r.ResolverResolvesTotal).To(h.MetricIncrementedBy(resolvesTotal, "==", 1))
 			Expect(r.ResolverResolveFailuresTotal).To(h.MetricIncrementedBy(resolveFailuresTotal, "==", 0))
 		})
+
+		It("should return the IPs of both families from the server", func() {
+			ips, err := resolver.Resolve(context.Background(), "an-instance.aivencloud.com")
+
+			By("checking the results")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ips).To(Equal([]net.IP{
+				net.ParseIP("10.0.0.1").To4(),
+				net.ParseIP("10.0.0.2").To4(),
+				net.ParseIP("fd00::1"),
+			}))
+		})
+
+		It("should only return the IPs of the family", func() {
+			var err error
+
+			resolver, err = r.NewResolver([]string{server.Addr()}, time.Second, 0, "ipv6")
+			Expect(err).NotTo(HaveOccurred())
+
+			ips, err := resolver.Resolve(context.Background(), "an-instance.aivencloud.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ips).To(Equal([]net.IP{net.ParseIP("fd00::1")}))
+		})
+
+		It("should cache the IPs for their TTL", func() {
+			_, err := resolver.Resolve(context.Background(), "an-instance.aivencloud.com")
+			Expect(err).NotTo(HaveOccurred())
+			queries := server.Queries()
+
+			By("resolving again from the cache")
+			ips, err := resolver.Resolve(context.Background(), "an-instance.aivencloud.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ips).To(HaveLen(3))
+			Expect(server.Queries()).To(Equal(queries))
+			Expect(r.ResolverCacheHitsTotal).To(h.MetricIncrementedBy(cacheHitsTotal, "==", 1))
+		})
+
+		It("should cache the IPs of a host which only has IPv4 addresses", func() {
+			server.SetRecords("an-ipv4-instance.aivencloud.com.", []net.IP{
+				net.ParseIP("10.0.0.3"),
+			})
+
+			ips, err := resolver.Resolve(context.Background(), "an-ipv4-instance.aivencloud.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ips).To(Equal([]net.IP{net.ParseIP("10.0.0.3").To4()}))
+			queries := server.Queries()
+
+			By("resolving again from the cache, despite the empty AAAA answer")
+			ips, err = resolver.Resolve(context.Background(), "an-ipv4-instance.aivencloud.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ips).To(Equal([]net.IP{net.ParseIP("10.0.0.3").To4()}))
+			Expect(server.Queries()).To(Equal(queries))
+			Expect(r.ResolverCacheHitsTotal).To(h.MetricIncrementedBy(cacheHitsTotal, "==", 1))
+		})
+
+		It("should not cache IPs with a TTL of zero", func() {
+			server.SetTTL(0)
+
+			_, err := resolver.Resolve(context.Background(), "an-instance.aivencloud.com")
+			Expect(err).NotTo(HaveOccurred())
+			queries := server.Queries()
+
+			_, err = resolver.Resolve(context.Background(), "an-instance.aivencloud.com")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(server.Queries()).To(BeNumerically(">", queries))
+		})
 	})
 
 	Context("when resolving fails", func() {
 		It("should return an error IPs and increment failure and total metrics", func() {
-			ips, err := resolver.Resolve("")
+			ips, err := resolver.Resolve(context.Background(), "")
 
 			By("checking the results")
 			Expect(err).To(HaveOccurred())
@@ -52,5 +288,55 @@ var _ = Describe("Resolver", func() {
 			Expect(r.ResolverResolvesTotal).To(h.MetricIncrementedBy(resolvesTotal, "==", 1))
 			Expect(r.ResolverResolveFailuresTotal).To(h.MetricIncrementedBy(resolveFailuresTotal, "==", 1))
 		})
+
+		It("should not retry when the host does not exist", func() {
+			_, err := resolver.Resolve(context.Background(), "not-an-instance.aivencloud.com")
+			Expect(err).To(MatchError(ContainSubstring("no such host")))
+
+			By("querying once for each family")
+			Expect(server.Queries()).To(Equal(2))
+		})
+
+		It("should retry after the timeout when the server does not answer", func() {
+			server.SetDropping(true)
+
+			start := time.Now()
+			_, err := resolver.Resolve(context.Background(), "an-instance.aivencloud.com")
+			Expect(err).To(HaveOccurred())
+
+			By("querying twice for each family")
+			Expect(server.Queries()).To(Equal(4))
+			Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		})
+
+		It("should not accept an answer to another question", func() {
+			server.SetMisanswering(true)
+
+			_, err := resolver.Resolve(context.Background(), "an-instance.aivencloud.com")
+			Expect(err).To(MatchError(ContainSubstring("question does not match")))
+		})
+
+		It("should give up without retrying when the context is done", func() {
+			server.SetDropping(true)
+
+			var err error
+			resolver, err = r.NewResolver([]string{server.Addr()}, time.Minute, 5, "ipv4")
+			Expect(err).NotTo(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			_, err = resolver.Resolve(ctx, "an-instance.aivencloud.com")
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+
+			Expect(server.Queries()).To(Equal(1))
+			Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+		})
+	})
+
+	It("should return an error when the family is invalid", func() {
+		_, err := r.NewResolver(nil, time.Second, 0, "ipv5")
+		Expect(err).To(MatchError(ContainSubstring("ipv5")))
 	})
 })
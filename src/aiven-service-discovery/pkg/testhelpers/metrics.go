@@ -8,12 +8,46 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	putil "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func CurrentMetricValue(metric prometheus.Collector) float64 {
 	return putil.ToFloat64(metric)
 }
 
+// MetricHasSeries returns whether the metric has a series with exactly the
+// label values, without creating the series as WithLabelValues would
+func MetricHasSeries(metric prometheus.Collector, labelValues ...string) bool {
+	metrics := make(chan prometheus.Metric, 1000)
+	metric.Collect(metrics)
+	close(metrics)
+
+	for m := range metrics {
+		var written dto.Metric
+		if err := m.Write(&written); err != nil {
+			continue
+		}
+
+		labels := written.GetLabel()
+		if len(labels) != len(labelValues) {
+			continue
+		}
+
+		matches := true
+		for index, label := range labels {
+			if label.GetValue() != labelValues[index] {
+				matches = false
+			}
+		}
+
+		if matches {
+			return true
+		}
+	}
+
+	return false
+}
+
 func MetricIncrementedBy(
 	before float64,
 	comparator string,
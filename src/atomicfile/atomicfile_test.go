@@ -0,0 +1,80 @@
+package atomicfile_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-observability-release/src/atomicfile"
+)
+
+var _ = Describe("WriteFile", func() {
+	var (
+		err   error
+		tempd string
+		path  string
+	)
+
+	BeforeEach(func() {
+		tempd, err = ioutil.TempDir("", "atomicfile")
+		Expect(err).NotTo(HaveOccurred())
+
+		path = filepath.Join(tempd, "targets.json")
+	})
+
+	AfterEach(func() {
+		if tempd != "" {
+			os.RemoveAll(tempd)
+		}
+	})
+
+	It("should create the file with the contents and permissions", func() {
+		err = atomicfile.WriteFile(path, []byte(`[]`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contents).To(Equal([]byte(`[]`)))
+
+		info, err := os.Stat(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0644)))
+	})
+
+	It("should replace the contents of an existing file", func() {
+		err = ioutil.WriteFile(path, []byte(`["a-much-longer-previous-value"]`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = atomicfile.WriteFile(path, []byte(`[]`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contents).To(Equal([]byte(`[]`)))
+	})
+
+	It("should not leave temporary files behind", func() {
+		err = atomicfile.WriteFile(path, []byte(`[]`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		entries, err := ioutil.ReadDir(tempd)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Name()).To(Equal("targets.json"))
+	})
+
+	It("should return an error and leave the file alone when it cannot write", func() {
+		err = ioutil.WriteFile(path, []byte(`["previous"]`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = atomicfile.WriteFile(filepath.Join(path, "not-a-dir"), []byte(`[]`), 0644)
+		Expect(err).To(HaveOccurred())
+
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contents).To(Equal([]byte(`["previous"]`)))
+	})
+})
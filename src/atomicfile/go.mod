@@ -0,0 +1,8 @@
+module github.com/alphagov/paas-observability-release/src/atomicfile
+
+go 1.13
+
+require (
+	github.com/onsi/ginkgo v1.10.3
+	github.com/onsi/gomega v1.7.1
+)
@@ -6,6 +6,8 @@ require (
 	code.cloudfoundry.org/clock v1.0.0 // indirect
 	code.cloudfoundry.org/lager v2.0.0+incompatible
 	code.cloudfoundry.org/tlsconfig v0.0.0-20200131000646-bbe0f8da39b3 // indirect
+	github.com/alphagov/paas-observability-release/src/atomicfile v0.0.0
+	github.com/alphagov/paas-observability-release/src/health v0.0.0
 	github.com/bmatcuk/doublestar v1.2.2 // indirect
 	github.com/charlievieth/fs v0.0.0-20170613215519-7dc373669fa1 // indirect
 	github.com/cloudfoundry/bosh-cli v6.2.1+incompatible
@@ -22,5 +24,10 @@ require (
 	github.com/onsi/gomega v1.9.0
 	github.com/pivotal-cf/paraphernalia v0.0.0-20180203224945-a64ae2051c20 // indirect
 	github.com/prometheus/client_golang v1.4.1
+	github.com/prometheus/client_model v0.2.0
 	github.com/tedsuo/ifrit v0.0.0-20191009134036-9a97d0632f00 // indirect
 )
+
+replace github.com/alphagov/paas-observability-release/src/atomicfile => ../atomicfile
+
+replace github.com/alphagov/paas-observability-release/src/health => ../health
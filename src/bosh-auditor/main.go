@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"sync"
@@ -13,10 +14,14 @@ import (
 	"time"
 
 	"code.cloudfoundry.org/lager"
+	boshdir "github.com/cloudfoundry/bosh-cli/director"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/alphagov/paas-observability-release/src/health"
+
 	c "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/cursor"
 	f "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/fetcher"
+	fl "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/filter"
 	s "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/shipper"
 )
 
@@ -24,6 +29,9 @@ var (
 	lookbackDuration     time.Duration
 	prometheusListenPort uint
 
+	fetchStalenessThreshold time.Duration
+	shipStalenessThreshold  time.Duration
+
 	boshClientID     string
 	boshClientSecret string
 
@@ -33,8 +41,21 @@ var (
 	boshURL string
 	uaaURL  string
 
-	splunkHECEndpoint string
-	splunkToken       string
+	splunkHECEndpoint    string
+	splunkToken          string
+	splunkBatchMaxEvents int
+	splunkBatchMaxBytes  int
+
+	webhookURL            string
+	webhookToken          string
+	webhookBatchMaxEvents int
+
+	filePath string
+
+	syslogNetwork string
+	syslogAddress string
+
+	filterConfig string
 
 	cursorDir string
 	deployEnv string
@@ -52,6 +73,17 @@ func main() {
 		"Port on which prometheus metrics will be exposed via /metrics",
 	)
 
+	flag.DurationVar(
+		&fetchStalenessThreshold,
+		"fetch-staleness-threshold", 5*time.Minute,
+		"Duration after the last successful fetch of events at which /healthz fails",
+	)
+	flag.DurationVar(
+		&shipStalenessThreshold,
+		"ship-staleness-threshold", 5*time.Minute,
+		"Duration after the last successful ship to a destination at which /healthz fails",
+	)
+
 	flag.StringVar(
 		&boshClientID,
 		"bosh-client-id", "",
@@ -96,6 +128,56 @@ func main() {
 		"Token for Splunk HTTP Event Collector which will receive shipped events",
 	)
 
+	flag.IntVar(
+		&splunkBatchMaxEvents,
+		"splunk-batch-max-events", 100,
+		"Maximum number of events shipped to Splunk HTTP Event Collector in a single request",
+	)
+	flag.IntVar(
+		&splunkBatchMaxBytes,
+		"splunk-batch-max-bytes", 512*1024,
+		"Maximum size in bytes of a single request to Splunk HTTP Event Collector",
+	)
+
+	flag.StringVar(
+		&webhookURL,
+		"webhook-url", "",
+		"URL of a generic HTTP webhook which will receive shipped events",
+	)
+	flag.StringVar(
+		&webhookToken,
+		"webhook-token", "",
+		"Optional bearer token for the HTTP webhook",
+	)
+	flag.IntVar(
+		&webhookBatchMaxEvents,
+		"webhook-batch-max-events", 100,
+		"Maximum number of events shipped to the HTTP webhook in a single request",
+	)
+
+	flag.StringVar(
+		&filePath,
+		"file-path", "",
+		"Path of a local file to which shipped events will be appended as newline-delimited JSON",
+	)
+
+	flag.StringVar(
+		&syslogNetwork,
+		"syslog-network", "tcp",
+		"Network used to ship events to syslog, either tcp or udp",
+	)
+	flag.StringVar(
+		&syslogAddress,
+		"syslog-address", "",
+		"Address of a syslog server which will receive shipped events as RFC 5424 messages",
+	)
+
+	flag.StringVar(
+		&filterConfig,
+		"filter-config", "",
+		"Optional path of a JSON file containing rules for filtering and redacting events before they are shipped",
+	)
+
 	flag.StringVar(
 		&cursorDir,
 		"cursor-dir", "",
@@ -114,6 +196,10 @@ func main() {
 		log.Fatalf("Flag invalid: --prometheus-listen-port must be between 1 and 65535")
 	}
 
+	if fetchStalenessThreshold <= 0 || shipStalenessThreshold <= 0 {
+		log.Fatalf("Flag invalid: --fetch-staleness-threshold and --ship-staleness-threshold must be positive")
+	}
+
 	if boshClientID == "" || boshClientSecret == "" {
 		log.Fatalf("Flag invalid: --bosh-client-id and --bosh-client-secret must be provided")
 	}
@@ -126,8 +212,16 @@ func main() {
 		log.Fatalf("Flag invalid: --bosh-url and --uaa-url must be provided")
 	}
 
-	if splunkHECEndpoint == "" || splunkToken == "" {
-		log.Fatalf("Flag invalid: --splunk-hec-endpoint and --splunk-token must be provided")
+	if (splunkHECEndpoint == "") != (splunkToken == "") {
+		log.Fatalf("Flag invalid: --splunk-hec-endpoint and --splunk-token must be provided together")
+	}
+
+	if splunkBatchMaxEvents < 1 || splunkBatchMaxBytes < 1 {
+		log.Fatalf("Flag invalid: --splunk-batch-max-events and --splunk-batch-max-bytes must be positive")
+	}
+
+	if webhookBatchMaxEvents < 1 {
+		log.Fatalf("Flag invalid: --webhook-batch-max-events must be positive")
 	}
 
 	if cursorDir == "" {
@@ -141,10 +235,78 @@ func main() {
 	logger := lager.NewLogger("bosh-auditor")
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.INFO))
 
+	parsedBoshURL, err := url.Parse(boshURL)
+	if err != nil {
+		log.Fatalf("Flag invalid: --bosh-url could not be parsed: %s", err)
+	}
+	boshHost := parsedBoshURL.Hostname()
+
+	destinations := make([]s.Destination, 0)
+
+	if splunkHECEndpoint != "" {
+		destinations = append(destinations, s.NewSplunkDestination(
+			deployEnv,
+			boshHost,
+			splunkToken,
+			splunkHECEndpoint,
+			splunkBatchMaxEvents,
+			splunkBatchMaxBytes,
+		))
+	}
+
+	if webhookURL != "" {
+		destinations = append(destinations, s.NewWebhookDestination(
+			deployEnv,
+			webhookToken,
+			webhookURL,
+			webhookBatchMaxEvents,
+		))
+	}
+
+	if filePath != "" {
+		destinations = append(destinations, s.NewFileDestination(
+			deployEnv,
+			filePath,
+		))
+	}
+
+	if syslogAddress != "" {
+		destination, err := s.NewSyslogDestination(
+			deployEnv,
+			syslogNetwork,
+			syslogAddress,
+		)
+		if err != nil {
+			log.Fatalf("Flag invalid: %s", err)
+		}
+		destinations = append(destinations, destination)
+	}
+
+	if len(destinations) == 0 {
+		log.Fatalf("Flag invalid: at least one of --splunk-hec-endpoint, --webhook-url, --file-path or --syslog-address must be provided")
+	}
+
+	rules := fl.Rules{}
+	if filterConfig != "" {
+		rules, err = fl.LoadRules(filterConfig)
+		if err != nil {
+			log.Fatalf("Flag invalid: --filter-config: %s", err)
+		}
+	}
+
+	filter, err := fl.NewFilter(rules, logger)
+	if err != nil {
+		log.Fatalf("Flag invalid: --filter-config: %s", err)
+	}
+
 	logger.Info("configured", lager.Data{
-		"lookback-duration":      lookbackDuration.String(),
-		"prometheus-listen-port": prometheusListenPort,
-		"splunk-hec-endpoint":    splunkHECEndpoint,
+		"lookback-duration":       lookbackDuration.String(),
+		"prometheus-listen-port":  prometheusListenPort,
+		"splunk-hec-endpoint":     splunkHECEndpoint,
+		"splunk-batch-max-events": splunkBatchMaxEvents,
+		"splunk-batch-max-bytes":  splunkBatchMaxBytes,
+		"destinations":            len(destinations),
+		"filter-config":           filterConfig,
 	})
 
 	ctx, shutdown := context.WithCancel(context.Background())
@@ -156,58 +318,111 @@ func main() {
 		shutdown()
 	}()
 
+	checker := health.NewChecker()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	checker.Handle(mux)
+
 	metricsServer := &http.Server{
 		Addr:    fmt.Sprintf(":%d", prometheusListenPort),
-		Handler: promhttp.Handler(),
+		Handler: mux,
 	}
 
-	var wg sync.WaitGroup
-
-	wg.Add(1)
 	go func() {
 		err := metricsServer.ListenAndServe()
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			logger.Error("err-fatal-metrics-server", err)
+			os.Exit(1)
 		}
-		shutdown()
-		os.Exit(1)
 	}()
 
-	wg.Add(1)
-	go func() {
+	fetcher := f.NewFetcher(
+		boshURL,
+		uaaURL,
+		boshClientID,
+		boshClientSecret,
+		boshCACert,
+		uaaCACert,
+		filter.EventsFilter(),
+		logger,
+	)
+
+	lastFetch := &health.Timestamp{}
+	fetcher = healthyFetcher(fetcher, lastFetch)
+	checker.Register("fetch", fetchStalenessThreshold, lastFetch.LastSuccess)
+
+	var wg sync.WaitGroup
+
+	// Each destination has its own shipper and cursor, so that a slow or
+	// unavailable destination does not hold up the others
+	for _, destination := range destinations {
+		name := fmt.Sprintf("bosh-auditor-%s-shipper", destination.Name())
+
 		cursor := c.NewFileCursor(
-			"bosh-auditor-splunk-shipper",
+			name,
 			cursorDir,
 			time.Now().Add(-1*lookbackDuration),
-			logger.Session("bosh-auditor-splunk-shipper-file-cursor"),
+			logger.Session(fmt.Sprintf("%s-file-cursor", name)),
 		)
 
-		fetcher := f.NewFetcher(
-			boshURL,
-			uaaURL,
-			boshClientID,
-			boshClientSecret,
-			boshCACert,
-			uaaCACert,
-		)
+		lastShip := &health.Timestamp{}
+		checker.Register("ship-"+destination.Name(), shipStalenessThreshold, lastShip.LastSuccess)
 
 		shipper := s.NewShipper(
 			20*time.Second,
-			logger.Session("bosh-auditor-splunk-shipper"),
+			logger.Session(name),
 			cursor,
 			fetcher,
-			deployEnv,
-			splunkToken,
-			splunkHECEndpoint,
+			filter,
+			&healthyDestination{destination, lastShip},
 		)
 
-		err := shipper.Run(ctx)
-		if err != nil {
-			logger.Error("err-fatal-shipper", err)
-		}
-		shutdown()
-		os.Exit(1)
-	}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// A shipper only returns without an error once the context is
+			// done, which lets the other shippers finish their batches
+			err := shipper.Run(ctx)
+			if err != nil && ctx.Err() == nil {
+				logger.Error("err-fatal-shipper", err)
+				os.Exit(1)
+			}
+		}()
+	}
 
 	wg.Wait()
+	logger.Info("shutting-down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	metricsServer.Shutdown(shutdownCtx)
+}
+
+// healthyFetcher records when events were last fetched successfully
+func healthyFetcher(fetcher f.Fetcher, lastSuccess *health.Timestamp) f.Fetcher {
+	return func(t time.Time) ([]boshdir.Event, error) {
+		events, err := fetcher(t)
+		if err == nil {
+			lastSuccess.Succeeded()
+		}
+		return events, err
+	}
+}
+
+// healthyDestination records when a destination last shipped successfully.
+// The shipper calls Ship even when there are no new events, so an idle
+// director does not make the destination look stale
+type healthyDestination struct {
+	s.Destination
+	lastSuccess *health.Timestamp
+}
+
+func (d *healthyDestination) Ship(events []boshdir.Event) (int, error) {
+	shipped, err := d.Destination.Ship(events)
+	if err == nil {
+		d.lastSuccess.Succeeded()
+	}
+	return shipped, err
 }
@@ -4,7 +4,15 @@ import (
 	"time"
 )
 
+// Position is the last event which has been shipped. EventID is empty when
+// no event has been shipped, or when the position was migrated from a cursor
+// which only recorded the time
+type Position struct {
+	Time    time.Time
+	EventID string
+}
+
 type Cursor interface {
-	GetTime() time.Time
-	UpdateTime(time.Time) error
+	GetPosition() Position
+	UpdatePosition(Position) error
 }
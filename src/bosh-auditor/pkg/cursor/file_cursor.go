@@ -1,16 +1,25 @@
 package cursor
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"code.cloudfoundry.org/lager"
+
+	"github.com/alphagov/paas-observability-release/src/atomicfile"
 )
 
+type fileCursorContents struct {
+	Timestamp int64  `json:"timestamp"`
+	EventID   string `json:"event_id"`
+}
+
 type fileCursor struct {
 	name        string
 	dir         string
@@ -18,7 +27,7 @@ type fileCursor struct {
 
 	logger lager.Logger
 
-	mu sync.RWMutex
+	mu sync.Mutex
 }
 
 func NewFileCursor(
@@ -35,7 +44,7 @@ func NewFileCursor(
 
 		logger: logger,
 
-		mu: sync.RWMutex{},
+		mu: sync.Mutex{},
 	}
 }
 
@@ -44,40 +53,88 @@ func (c *fileCursor) path() (string, error) {
 	return filepath.Abs(joined)
 }
 
-func (c *fileCursor) GetTime() time.Time {
-	lsession := c.logger.Session("get-time")
+func (c *fileCursor) backupPath(path string) string {
+	return path + ".backup"
+}
+
+// read returns the position stored in the file at path, and whether the file
+// was in the legacy format which only contained the time in Unix seconds
+func (c *fileCursor) read(path string) (Position, bool, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Position{}, false, err
+	}
 
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	tint64, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+	if err == nil {
+		return Position{Time: time.Unix(tint64, 0)}, true, nil
+	}
+
+	var parsed fileCursorContents
+	err = json.Unmarshal(contents, &parsed)
+	if err != nil {
+		return Position{}, false, err
+	}
+
+	if parsed.Timestamp == 0 {
+		return Position{}, false, fmt.Errorf("Cursor %s does not contain a timestamp", path)
+	}
+
+	return Position{
+		Time:    time.Unix(parsed.Timestamp, 0),
+		EventID: parsed.EventID,
+	}, false, nil
+}
+
+func (c *fileCursor) GetPosition() Position {
+	lsession := c.logger.Session("get-position")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	defaultPosition := Position{Time: c.defaultTime}
 
 	path, err := c.path()
 	if err != nil {
 		lsession.Error("path", err)
 		lsession.Info("path-fallback", lager.Data{"default-time": c.defaultTime})
-		return c.defaultTime
+		return defaultPosition
 	}
 
-	contents, err := ioutil.ReadFile(path)
+	position, legacy, err := c.read(path)
 	if err != nil {
 		lsession.Error("read-file", err)
-		lsession.Info("read-file-fallback", lager.Data{"default-time": c.defaultTime})
-		return c.defaultTime
-	}
 
-	tint64, err := strconv.ParseInt(string(contents), 10, 64)
-	if err != nil {
-		lsession.Error("parse-int", err)
-		lsession.Info("parse-int-fallback", lager.Data{"default-time": c.defaultTime})
-		return c.defaultTime
+		position, _, err = c.read(c.backupPath(path))
+		if err != nil {
+			lsession.Error("read-backup-file", err)
+			lsession.Info("read-file-fallback", lager.Data{"default-time": c.defaultTime})
+			return defaultPosition
+		}
+
+		lsession.Info("recover-from-backup", lager.Data{
+			"time": position.Time, "event-id": position.EventID,
+		})
+
+		if err := c.write(path, position); err != nil {
+			lsession.Error("recover-write-file", err)
+		}
+	} else if legacy {
+		lsession.Info("migrate", lager.Data{"time": position.Time})
+
+		if err := c.write(path, position); err != nil {
+			lsession.Error("migrate-write-file", err)
+		}
 	}
 
-	tunix := time.Unix(tint64, 0)
-	lsession.Info("end-get-time", lager.Data{"time": tunix})
-	return tunix
+	lsession.Info("end-get-position", lager.Data{
+		"time": position.Time, "event-id": position.EventID,
+	})
+	return position
 }
 
-func (c *fileCursor) UpdateTime(t time.Time) error {
-	lsession := c.logger.Session("update-time")
+func (c *fileCursor) UpdatePosition(position Position) error {
+	lsession := c.logger.Session("update-position")
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -88,12 +145,49 @@ func (c *fileCursor) UpdateTime(t time.Time) error {
 		return err
 	}
 
-	err = ioutil.WriteFile(path, []byte(fmt.Sprintf("%d", t.Unix())), 0644)
+	err = c.write(path, position)
 	if err != nil {
 		lsession.Error("write-file", err)
 		return err
 	}
 
-	lsession.Info("end-update-time", lager.Data{"time": t})
+	lsession.Info("end-update-position", lager.Data{
+		"time": position.Time, "event-id": position.EventID,
+	})
 	return nil
 }
+
+func (c *fileCursor) marshal(position Position) ([]byte, error) {
+	contents, err := json.Marshal(fileCursorContents{
+		Timestamp: position.Time.Unix(),
+		EventID:   position.EventID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not marshal cursor: %s", err)
+	}
+
+	return contents, nil
+}
+
+// write keeps the previous position as a backup generation, only if it is
+// readable, then atomically replaces the cursor file with the new position
+func (c *fileCursor) write(path string, position Position) error {
+	if previous, _, err := c.read(path); err == nil {
+		contents, err := c.marshal(previous)
+		if err != nil {
+			return err
+		}
+
+		err = atomicfile.WriteFile(c.backupPath(path), contents, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	contents, err := c.marshal(position)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(path, contents, 0644)
+}
@@ -3,6 +3,7 @@ package cursor_test
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
 	"code.cloudfoundry.org/lager"
@@ -45,39 +46,112 @@ var _ = Describe("FileCursor", func() {
 	})
 
 	Context("when using a cursor", func() {
-		It("should set the time, then get the time", func() {
+		It("should set the position, then get the position", func() {
 			currTime := time.Now()
-			err = fc.UpdateTime(currTime)
+			err = fc.UpdatePosition(cursor.Position{Time: currTime, EventID: "1234"})
 			Expect(err).NotTo(HaveOccurred())
 
-			gotTime := fc.GetTime()
-			Expect(currTime).To(BeTemporally("~", gotTime, 1*time.Second))
+			gotPosition := fc.GetPosition()
+			Expect(currTime).To(BeTemporally("~", gotPosition.Time, 1*time.Second))
+			Expect(gotPosition.EventID).To(Equal("1234"))
 		})
 	})
 
-	Context("when getting the time", func() {
-		Context("when the time has not been set", func() {
-			It("should fallback to the default value", func() {
-				gotTime := fc.GetTime()
-				Expect(time.Unix(0, 0)).To(BeTemporally("~", gotTime, 1*time.Second))
+	Context("when getting the position", func() {
+		Context("when the position has not been set", func() {
+			It("should fallback to the default time", func() {
+				gotPosition := fc.GetPosition()
+				Expect(time.Unix(0, 0)).To(BeTemporally("~", gotPosition.Time, 1*time.Second))
+				Expect(gotPosition.EventID).To(Equal(""))
 			})
 		})
 
 		Context("when the file does not exist", func() {
-			It("should fallback to the default value", func() {
+			It("should fallback to the default time", func() {
 				fc = cursor.NewFileCursor(
 					"test-cursor",
 					"/path/does/not/exist",
 					time.Unix(0, 0),
 					logger,
 				)
-				gotTime := fc.GetTime()
-				Expect(time.Unix(0, 0)).To(BeTemporally("~", gotTime, 1*time.Second))
+				gotPosition := fc.GetPosition()
+				Expect(time.Unix(0, 0)).To(BeTemporally("~", gotPosition.Time, 1*time.Second))
+				Expect(gotPosition.EventID).To(Equal(""))
+			})
+		})
+
+		Context("when the file is corrupt", func() {
+			It("should fallback to the default time", func() {
+				err = ioutil.WriteFile(filepath.Join(tempd, "test-cursor"), []byte(`{"timest`), 0644)
+				Expect(err).NotTo(HaveOccurred())
+
+				gotPosition := fc.GetPosition()
+				Expect(time.Unix(0, 0)).To(BeTemporally("~", gotPosition.Time, 1*time.Second))
+				Expect(gotPosition.EventID).To(Equal(""))
+			})
+		})
+
+		Context("when the file is corrupt and there is a backup", func() {
+			It("should recover the previous position from the backup", func() {
+				path := filepath.Join(tempd, "test-cursor")
+
+				err = fc.UpdatePosition(cursor.Position{Time: time.Unix(1234, 0), EventID: "1"})
+				Expect(err).NotTo(HaveOccurred())
+				err = fc.UpdatePosition(cursor.Position{Time: time.Unix(1235, 0), EventID: "2"})
+				Expect(err).NotTo(HaveOccurred())
+
+				err = ioutil.WriteFile(path, []byte(`{"timest`), 0644)
+				Expect(err).NotTo(HaveOccurred())
+
+				gotPosition := fc.GetPosition()
+				Expect(gotPosition.Time).To(BeTemporally("==", time.Unix(1234, 0)))
+				Expect(gotPosition.EventID).To(Equal("1"))
+
+				By("restoring the cursor file from the backup")
+				contents, err := ioutil.ReadFile(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contents).To(MatchJSON(`{"timestamp": 1234, "event_id": "1"}`))
+			})
+		})
+
+		Context("when the file only contains the time", func() {
+			It("should migrate the file", func() {
+				path := filepath.Join(tempd, "test-cursor")
+
+				err = ioutil.WriteFile(path, []byte("1234"), 0644)
+				Expect(err).NotTo(HaveOccurred())
+
+				gotPosition := fc.GetPosition()
+				Expect(gotPosition.Time).To(BeTemporally("==", time.Unix(1234, 0)))
+				Expect(gotPosition.EventID).To(Equal(""))
+
+				contents, err := ioutil.ReadFile(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contents).To(MatchJSON(`{"timestamp": 1234, "event_id": ""}`))
 			})
 		})
 	})
 
-	Context("when setting the time", func() {
+	Context("when setting the position", func() {
+		It("should keep the previous position as a backup", func() {
+			err = fc.UpdatePosition(cursor.Position{Time: time.Unix(1234, 0), EventID: "1"})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = os.Stat(filepath.Join(tempd, "test-cursor.backup"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			err = fc.UpdatePosition(cursor.Position{Time: time.Unix(1235, 0), EventID: "2"})
+			Expect(err).NotTo(HaveOccurred())
+
+			contents, err := ioutil.ReadFile(filepath.Join(tempd, "test-cursor.backup"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(MatchJSON(`{"timestamp": 1234, "event_id": "1"}`))
+
+			contents, err = ioutil.ReadFile(filepath.Join(tempd, "test-cursor"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(MatchJSON(`{"timestamp": 1235, "event_id": "2"}`))
+		})
+
 		Context("when the file does not exist", func() {
 			It("should return an error", func() {
 				fc = cursor.NewFileCursor(
@@ -86,8 +160,7 @@ var _ = Describe("FileCursor", func() {
 					time.Unix(0, 0),
 					logger,
 				)
-				currTime := time.Now()
-				err = fc.UpdateTime(currTime)
+				err = fc.UpdatePosition(cursor.Position{Time: time.Now()})
 				Expect(err).To(HaveOccurred())
 			})
 		})
@@ -2,21 +2,43 @@ package fetcher
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
 	boshdir "github.com/cloudfoundry/bosh-cli/director"
 	boshuaa "github.com/cloudfoundry/bosh-cli/uaa"
 	boshlog "github.com/cloudfoundry/bosh-utils/logger"
-	"time"
 )
 
+// Fetcher returns every event after the given time, oldest first
 type Fetcher func(time.Time) ([]boshdir.Event, error)
 
-type fetcher struct {
-	boshCACert       string
-	uaaCACert        string
+// EventsLister is the subset of boshdir.Director used to fetch events
+type EventsLister interface {
+	Events(boshdir.EventsFilter) ([]boshdir.Event, error)
+}
+
+// boshFetcher holds the director client between fetches, so that a token is
+// only requested from UAA when the previous token expires
+type boshFetcher struct {
+	boshURL          string
+	uaaURL           string
 	boshClientID     string
 	boshClientSecret string
-	uaaURL           string
-	boshURL          string
+	boshCACert       string
+	uaaCACert        string
+
+	filter boshdir.EventsFilter
+
+	mu       sync.Mutex
+	director EventsLister
+	tokens   *TokenSession
+
+	logger lager.Logger
 }
 
 func NewFetcher(
@@ -26,46 +48,207 @@ func NewFetcher(
 	boshClientSecret string,
 	boshCACert string,
 	uaaCACert string,
+
+	filter boshdir.EventsFilter,
+
+	logger lager.Logger,
 ) Fetcher {
-	return func(t time.Time) ([]boshdir.Event, error) {
-		logger := boshlog.NewLogger(boshlog.LevelError)
-		uaaFactory := boshuaa.NewFactory(logger)
+	f := &boshFetcher{
+		boshURL:          boshURL,
+		uaaURL:           uaaURL,
+		boshClientID:     boshClientID,
+		boshClientSecret: boshClientSecret,
+		boshCACert:       boshCACert,
+		uaaCACert:        uaaCACert,
 
-		uaaConfig, err := boshuaa.NewConfigFromURL(uaaURL)
-		if err != nil {
-			fmt.Println(err)
-			return nil, err
-		}
+		filter: filter,
 
-		uaaConfig.Client = boshClientID
-		uaaConfig.ClientSecret = boshClientSecret
-		uaaConfig.CACert = uaaCACert
+		logger: logger.Session("fetcher"),
+	}
 
-		uaa, err := uaaFactory.New(uaaConfig)
-		if err != nil {
-			fmt.Println(err)
-			return nil, err
+	return f.fetch
+}
+
+func (f *boshFetcher) fetch(t time.Time) ([]boshdir.Event, error) {
+	lsession := f.logger.Session("fetch")
+
+	director, tokens, err := f.client()
+	if err != nil {
+		lsession.Error("err-client", err)
+		return nil, err
+	}
+
+	filter := f.filter
+	filter.After = t.Format(time.RFC3339)
+
+	events, pages, err := FetchAllPages(director, filter)
+	if err != nil {
+		lsession.Error("err-fetch-all-pages", err, lager.Data{"pages": pages})
+
+		if tokens.Failed() || isAuthError(err) {
+			FetcherAuthFailuresTotal.Inc()
+			lsession.Info("rebuilding-client-after-auth-failure")
+			f.reset(director)
 		}
 
-		boshFactory := boshdir.NewFactory(logger)
+		return nil, err
+	}
+
+	lsession.Info("fetched", lager.Data{"events": len(events), "pages": pages})
+	return events, nil
+}
+
+// client returns the director client, building it when it has not been
+// built yet or has been reset after an auth failure
+func (f *boshFetcher) client() (EventsLister, *TokenSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.director != nil {
+		return f.director, f.tokens, nil
+	}
+
+	lsession := f.logger.Session("build-client")
+
+	boshLogger := boshlog.NewLogger(boshlog.LevelError)
+	uaaFactory := boshuaa.NewFactory(boshLogger)
+
+	uaaConfig, err := boshuaa.NewConfigFromURL(f.uaaURL)
+	if err != nil {
+		lsession.Error("err-uaa-new-config-from-url", err)
+		return nil, nil, err
+	}
+
+	uaaConfig.Client = f.boshClientID
+	uaaConfig.ClientSecret = f.boshClientSecret
+	uaaConfig.CACert = f.uaaCACert
+
+	uaa, err := uaaFactory.New(uaaConfig)
+	if err != nil {
+		lsession.Error("err-uaa-new", err)
+		return nil, nil, err
+	}
+
+	boshFactory := boshdir.NewFactory(boshLogger)
+
+	boshConfig, err := boshdir.NewConfigFromURL(f.boshURL)
+	if err != nil {
+		lsession.Error("err-bosh-new-config-from-url", err)
+		return nil, nil, err
+	}
+
+	tokens := NewTokenSession(uaa, f.logger)
+
+	boshConfig.CACert = f.boshCACert
+	boshConfig.TokenFunc = tokens.TokenFunc
+
+	bosh, err := boshFactory.New(boshConfig, boshdir.NewNoopTaskReporter(), boshdir.NewNoopFileReporter())
+	if err != nil {
+		lsession.Error("err-bosh-new", err)
+		return nil, nil, err
+	}
+
+	FetcherClientBuildsTotal.Inc()
+	lsession.Info("built")
+
+	f.director = bosh
+	f.tokens = tokens
+	return f.director, f.tokens, nil
+}
+
+// reset discards the director client, unless it has already been replaced
+// by a concurrent fetch
+func (f *boshFetcher) reset(director EventsLister) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.director == director {
+		f.director = nil
+		f.tokens = nil
+	}
+}
+
+// isAuthError returns true when the director rejected our token, even after
+// the director client retried with a fresh token
+func isAuthError(err error) bool {
+	return strings.Contains(err.Error(), "status code '401'") ||
+		strings.Contains(err.Error(), "status code '403'")
+}
+
+// FetchAllPages pages backwards through the events matching the filter,
+// using BeforeID, until the director returns no more events. The director
+// returns events newest first and caps the number of events per call, so
+// without paging we would only see the newest page.
+//
+// The events are returned oldest first, along with the number of pages
+// which were fetched
+func FetchAllPages(
+	lister EventsLister,
+	filter boshdir.EventsFilter,
+) ([]boshdir.Event, int, error) {
+	var (
+		events = make([]boshdir.Event, 0)
+		pages  = 0
+
+		lowestID = int64(-1)
+	)
+
+	for {
+		startTime := time.Now()
+		page, err := lister.Events(filter)
+		FetcherDirectorRequestDuration.Observe(time.Since(startTime).Seconds())
+		pages++
+		FetcherPagesFetchedTotal.Inc()
 
-		boshConfig, err := boshdir.NewConfigFromURL(boshURL)
 		if err != nil {
-			fmt.Println(err)
-			return nil, err
+			FetcherPageErrorsTotal.Inc()
+			return nil, pages, err
 		}
 
-		boshConfig.CACert = boshCACert
-		boshConfig.TokenFunc = boshuaa.NewClientTokenSession(uaa).TokenFunc
+		if len(page) == 0 {
+			break
+		}
 
-		bosh, err := boshFactory.New(boshConfig, boshdir.NewNoopTaskReporter(), boshdir.NewNoopFileReporter())
-		if err != nil {
-			fmt.Println(err)
-			return nil, err
+		pageLowestID := int64(-1)
+		for _, event := range page {
+			id, err := parseEventID(event)
+			if err != nil {
+				return nil, pages, err
+			}
+
+			if pageLowestID == -1 || id < pageLowestID {
+				pageLowestID = id
+			}
+		}
+
+		if lowestID != -1 && pageLowestID >= lowestID {
+			return nil, pages, fmt.Errorf(
+				"Director did not respect before_id %s when paging events",
+				filter.BeforeID,
+			)
 		}
 
-		return bosh.Events(boshdir.EventsFilter{
-			After: t.Format(time.RFC3339),
-		})
+		lowestID = pageLowestID
+		events = append(events, page...)
+		filter.BeforeID = strconv.FormatInt(lowestID, 10)
+	}
+
+	FetcherEventsFetchedTotal.Add(float64(len(events)))
+
+	sort.SliceStable(events, func(i, j int) bool {
+		// IDs have already been parsed successfully above
+		iID, _ := parseEventID(events[i])
+		jID, _ := parseEventID(events[j])
+		return iID < jID
+	})
+
+	return events, pages, nil
+}
+
+func parseEventID(event boshdir.Event) (int64, error) {
+	id, err := strconv.ParseInt(event.ID(), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Could not parse event ID %q: %s", event.ID(), err)
 	}
+	return id, nil
 }
@@ -0,0 +1,156 @@
+package fetcher_test
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	boshdir "github.com/cloudfoundry/bosh-cli/director"
+
+	f "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/fetcher"
+)
+
+// fakeLister behaves like the director: it returns at most pageSize events,
+// newest first, with an ID lower than BeforeID when it is provided
+type fakeLister struct {
+	events   []boshdir.Event
+	pageSize int
+
+	filters []boshdir.EventsFilter
+	err     error
+}
+
+func (l *fakeLister) Events(filter boshdir.EventsFilter) ([]boshdir.Event, error) {
+	l.filters = append(l.filters, filter)
+
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	beforeID := int64(-1)
+	if filter.BeforeID != "" {
+		beforeID, _ = strconv.ParseInt(filter.BeforeID, 10, 64)
+	}
+
+	page := make([]boshdir.Event, 0)
+	for i := len(l.events) - 1; i >= 0 && len(page) < l.pageSize; i-- {
+		id, _ := strconv.ParseInt(l.events[i].ID(), 10, 64)
+		if beforeID == -1 || id < beforeID {
+			page = append(page, l.events[i])
+		}
+	}
+
+	return page, nil
+}
+
+func eventsWithIDs(ids ...int) []boshdir.Event {
+	events := make([]boshdir.Event, 0)
+	for _, id := range ids {
+		events = append(events, boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
+			ID:        strconv.Itoa(id),
+			Timestamp: 1234,
+		}))
+	}
+	return events
+}
+
+func idsOf(events []boshdir.Event) []string {
+	ids := make([]string, 0)
+	for _, event := range events {
+		ids = append(ids, event.ID())
+	}
+	return ids
+}
+
+var _ = Describe("FetchAllPages", func() {
+	var (
+		lister *fakeLister
+	)
+
+	BeforeEach(func() {
+		lister = &fakeLister{pageSize: 3}
+	})
+
+	Context("when there are no events", func() {
+		It("should fetch a single page", func() {
+			events, pages, err := f.FetchAllPages(lister, boshdir.EventsFilter{
+				After: "2020-01-01T00:00:00Z",
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(events).To(HaveLen(0))
+			Expect(pages).To(Equal(1))
+		})
+	})
+
+	Context("when there are more events than fit in a page", func() {
+		It("should page through every event and return them oldest first", func() {
+			lister.events = eventsWithIDs(1, 2, 3, 4, 5, 6, 7, 8)
+
+			events, pages, err := f.FetchAllPages(lister, boshdir.EventsFilter{
+				After: "2020-01-01T00:00:00Z",
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(idsOf(events)).To(Equal([]string{
+				"1", "2", "3", "4", "5", "6", "7", "8",
+			}))
+			Expect(pages).To(Equal(4))
+
+			By("checking the filters which were used")
+			Expect(lister.filters).To(HaveLen(4))
+			for _, filter := range lister.filters {
+				Expect(filter.After).To(Equal("2020-01-01T00:00:00Z"))
+			}
+			Expect(lister.filters[0].BeforeID).To(Equal(""))
+			Expect(lister.filters[1].BeforeID).To(Equal("6"))
+			Expect(lister.filters[2].BeforeID).To(Equal("3"))
+			Expect(lister.filters[3].BeforeID).To(Equal("1"))
+		})
+
+		It("should order numerically rather than lexically", func() {
+			lister.events = eventsWithIDs(9, 10, 11)
+
+			events, _, err := f.FetchAllPages(lister, boshdir.EventsFilter{})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(idsOf(events)).To(Equal([]string{"9", "10", "11"}))
+			Expect(sort.StringsAreSorted(idsOf(events))).To(BeFalse())
+		})
+	})
+
+	Context("when the director returns an error", func() {
+		It("should return the error", func() {
+			lister.err = fmt.Errorf("director unavailable")
+
+			_, pages, err := f.FetchAllPages(lister, boshdir.EventsFilter{})
+
+			Expect(err).To(MatchError("director unavailable"))
+			Expect(pages).To(Equal(1))
+		})
+	})
+
+	Context("when the director ignores before_id", func() {
+		It("should return an error rather than looping forever", func() {
+			lister.events = eventsWithIDs(1, 2, 3)
+			lister.pageSize = 100
+
+			ignoring := &ignoringLister{lister}
+
+			_, _, err := f.FetchAllPages(ignoring, boshdir.EventsFilter{})
+			Expect(err).To(MatchError(ContainSubstring("did not respect before_id")))
+		})
+	})
+})
+
+type ignoringLister struct {
+	lister *fakeLister
+}
+
+func (l *ignoringLister) Events(filter boshdir.EventsFilter) ([]boshdir.Event, error) {
+	filter.BeforeID = ""
+	return l.lister.Events(filter)
+}
@@ -0,0 +1,5 @@
+package fetcher
+
+func init() {
+	initMetrics()
+}
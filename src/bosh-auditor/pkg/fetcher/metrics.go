@@ -0,0 +1,58 @@
+package fetcher
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	FetcherPagesFetchedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bosh_auditor_fetcher_pages_fetched_total",
+		Help: "Counter of total number of pages of bosh events fetched from the director",
+	})
+
+	FetcherPageErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bosh_auditor_fetcher_page_errors_total",
+		Help: "Counter of total number of failures fetching a page of bosh events",
+	})
+
+	FetcherEventsFetchedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bosh_auditor_fetcher_events_fetched_total",
+		Help: "Counter of total number of bosh events fetched from the director",
+	})
+
+	FetcherDirectorRequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "bosh_auditor_fetcher_director_request_duration_seconds",
+		Help: "Histogram of the duration of requests for a page of bosh events from the director",
+	})
+
+	FetcherTokenRefreshesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bosh_auditor_fetcher_token_refreshes_total",
+		Help: "Counter of total number of tokens requested from UAA for the director",
+	})
+
+	FetcherTokenRefreshErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bosh_auditor_fetcher_token_refresh_errors_total",
+		Help: "Counter of total number of failures requesting a token from UAA for the director",
+	})
+
+	FetcherAuthFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bosh_auditor_fetcher_auth_failures_total",
+		Help: "Counter of total number of fetches which failed to authenticate, after which the director client is rebuilt",
+	})
+
+	FetcherClientBuildsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bosh_auditor_fetcher_client_builds_total",
+		Help: "Counter of total number of times the director client has been built",
+	})
+)
+
+func initMetrics() {
+	prometheus.MustRegister(FetcherPagesFetchedTotal)
+	prometheus.MustRegister(FetcherPageErrorsTotal)
+	prometheus.MustRegister(FetcherEventsFetchedTotal)
+	prometheus.MustRegister(FetcherDirectorRequestDuration)
+	prometheus.MustRegister(FetcherTokenRefreshesTotal)
+	prometheus.MustRegister(FetcherTokenRefreshErrorsTotal)
+	prometheus.MustRegister(FetcherAuthFailuresTotal)
+	prometheus.MustRegister(FetcherClientBuildsTotal)
+}
@@ -0,0 +1,100 @@
+package fetcher
+
+import (
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	boshuaa "github.com/cloudfoundry/bosh-cli/uaa"
+)
+
+// tokenExpiryMargin is how long before a token expires that it is refreshed,
+// so that a token does not expire while a request is in flight
+const tokenExpiryMargin = 30 * time.Second
+
+// ClientCredentialsGranter is the subset of boshuaa.UAA used to get tokens
+type ClientCredentialsGranter interface {
+	ClientCredentialsGrant() (boshuaa.AccessToken, error)
+}
+
+// TokenSession provides tokens for the director client. Unlike
+// boshuaa.ClientTokenSession it refreshes the token before it expires,
+// rather than only after the director has rejected it
+type TokenSession struct {
+	uaa ClientCredentialsGranter
+
+	mu        sync.Mutex
+	token     boshuaa.AccessToken
+	expiresAt time.Time
+	failed    bool
+
+	logger lager.Logger
+}
+
+func NewTokenSession(uaa ClientCredentialsGranter, logger lager.Logger) *TokenSession {
+	return &TokenSession{
+		uaa:    uaa,
+		logger: logger.Session("token-session"),
+	}
+}
+
+// TokenFunc is used as the TokenFunc of the director client. retried is true
+// when the director rejected the previous token
+func (s *TokenSession) TokenFunc(retried bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token == nil || retried || s.expiresSoon() {
+		err := s.refresh(retried)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return s.token.Type() + " " + s.token.Value(), nil
+}
+
+// Failed returns true when the most recent attempt to get a token failed
+func (s *TokenSession) Failed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.failed
+}
+
+func (s *TokenSession) refresh(retried bool) error {
+	lsession := s.logger.Session("refresh", lager.Data{"retried": retried})
+
+	FetcherTokenRefreshesTotal.Inc()
+
+	token, err := s.uaa.ClientCredentialsGrant()
+	if err != nil {
+		FetcherTokenRefreshErrorsTotal.Inc()
+		lsession.Error("err-client-credentials-grant", err)
+		s.failed = true
+		return err
+	}
+
+	s.token = token
+	s.failed = false
+
+	// Tokens which cannot be parsed are used until the director rejects them
+	s.expiresAt = time.Time{}
+	info, err := boshuaa.NewTokenInfoFromValue(token.Value())
+	if err != nil {
+		lsession.Info("unknown-expiry", lager.Data{"error": err.Error()})
+		return nil
+	}
+	s.expiresAt = time.Unix(int64(info.ExpiredAt), 0)
+
+	lsession.Info("refreshed", lager.Data{"expires-at": s.expiresAt})
+	return nil
+}
+
+func (s *TokenSession) expiresSoon() bool {
+	if s.expiresAt.IsZero() {
+		return false
+	}
+
+	return time.Now().Add(tokenExpiryMargin).After(s.expiresAt)
+}
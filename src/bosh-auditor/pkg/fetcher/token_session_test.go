@@ -0,0 +1,104 @@
+package fetcher_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	boshuaa "github.com/cloudfoundry/bosh-cli/uaa"
+
+	f "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/fetcher"
+)
+
+// fakeGranter grants tokens which expire after ttl
+type fakeGranter struct {
+	ttl    time.Duration
+	grants int
+	err    error
+}
+
+func (g *fakeGranter) ClientCredentialsGrant() (boshuaa.AccessToken, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+
+	g.grants++
+
+	claims := fmt.Sprintf(`{"exp":%d}`, time.Now().Add(g.ttl).Unix())
+	value := fmt.Sprintf(
+		"header.%s.signature-%d",
+		base64.RawURLEncoding.EncodeToString([]byte(claims)),
+		g.grants,
+	)
+
+	return boshuaa.NewAccessToken("bearer", value), nil
+}
+
+var _ = Describe("TokenSession", func() {
+	var (
+		logger  lager.Logger
+		granter *fakeGranter
+		session *f.TokenSession
+	)
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("token-session-test")
+		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
+
+		granter = &fakeGranter{ttl: time.Hour}
+		session = f.NewTokenSession(granter, logger)
+	})
+
+	It("should reuse a token until it expires", func() {
+		first, err := session.TokenFunc(false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(first).To(HavePrefix("bearer header."))
+
+		second, err := session.TokenFunc(false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second).To(Equal(first))
+
+		Expect(granter.grants).To(Equal(1))
+	})
+
+	It("should refresh a token which is about to expire", func() {
+		granter.ttl = 10 * time.Second
+
+		first, err := session.TokenFunc(false)
+		Expect(err).NotTo(HaveOccurred())
+
+		second, err := session.TokenFunc(false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second).NotTo(Equal(first))
+
+		Expect(granter.grants).To(Equal(2))
+	})
+
+	It("should refresh a token which the director rejected", func() {
+		_, err := session.TokenFunc(false)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = session.TokenFunc(true)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(granter.grants).To(Equal(2))
+	})
+
+	It("should report when a token could not be granted", func() {
+		granter.err = fmt.Errorf("uaa unavailable")
+
+		_, err := session.TokenFunc(false)
+		Expect(err).To(MatchError("uaa unavailable"))
+		Expect(session.Failed()).To(BeTrue())
+
+		granter.err = nil
+
+		_, err = session.TokenFunc(false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(session.Failed()).To(BeFalse())
+	})
+})
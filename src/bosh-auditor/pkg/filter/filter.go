@@ -0,0 +1,261 @@
+package filter
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	boshdir "github.com/cloudfoundry/bosh-cli/director"
+)
+
+const redactedValue = "[REDACTED]"
+
+// Filter sits between the fetcher and the shippers, dropping events which
+// do not match the rules and redacting sensitive context
+type Filter interface {
+	// EventsFilter is the part of the rules the director can apply itself
+	EventsFilter() boshdir.EventsFilter
+
+	// Apply returns the events which should be shipped, oldest first. Each
+	// shipper applies the filter to the events it fetches, so events are
+	// only counted the first time any shipper sees them
+	Apply([]boshdir.Event) []boshdir.Event
+}
+
+type criteria struct {
+	actions     map[string]bool
+	objectTypes map[string]bool
+	deployments map[string]bool
+	users       map[string]bool
+	objectName  *regexp.Regexp
+}
+
+type filter struct {
+	rules Rules
+
+	include *criteria
+	exclude *criteria
+
+	redactKeys map[string]bool
+
+	// countedID is the highest event ID which has been counted in the
+	// metrics, so that events fetched again, or by another shipper, are not
+	// counted twice
+	mu        sync.Mutex
+	countedID int64
+
+	logger lager.Logger
+}
+
+func NewFilter(rules Rules, logger lager.Logger) (Filter, error) {
+	err := rules.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	redactKeys := make(map[string]bool)
+	for _, key := range rules.RedactContextKeys {
+		redactKeys[strings.ToLower(key)] = true
+	}
+
+	return &filter{
+		rules: rules,
+
+		include: newCriteria(rules.Include),
+		exclude: newCriteria(rules.Exclude),
+
+		redactKeys: redactKeys,
+
+		logger: logger.Session("filter"),
+	}, nil
+}
+
+func (f *filter) EventsFilter() boshdir.EventsFilter {
+	// The director only accepts a single value for each field, so the
+	// director can only help when there is exactly one value to include
+	only := func(values []string) string {
+		if len(values) == 1 {
+			return values[0]
+		}
+		return ""
+	}
+
+	return boshdir.EventsFilter{
+		Action:     only(f.rules.Include.Actions),
+		ObjectType: only(f.rules.Include.ObjectTypes),
+		Deployment: only(f.rules.Include.Deployments),
+		User:       only(f.rules.Include.Users),
+	}
+}
+
+func (f *filter) Apply(events []boshdir.Event) []boshdir.Event {
+	lsession := f.logger.Session("apply")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	filtered := make([]boshdir.Event, 0, len(events))
+	dropped := 0
+	redacted := 0
+
+	for _, event := range events {
+		counted := f.counted(event)
+
+		if f.include != nil && !f.include.matches(event) {
+			if !counted {
+				FilterEventsDroppedTotal.WithLabelValues("include").Inc()
+			}
+			dropped++
+			continue
+		}
+
+		if f.exclude != nil && f.exclude.matches(event) {
+			if !counted {
+				FilterEventsDroppedTotal.WithLabelValues("exclude").Inc()
+			}
+			dropped++
+			continue
+		}
+
+		event, keys := f.redact(event)
+		if !counted {
+			FilterContextKeysRedactedTotal.Add(float64(keys))
+		}
+		redacted += keys
+		filtered = append(filtered, event)
+	}
+
+	if dropped > 0 || redacted > 0 {
+		lsession.Info("filtered", lager.Data{
+			"events":   len(events),
+			"dropped":  dropped,
+			"redacted": redacted,
+		})
+	}
+
+	return filtered
+}
+
+// counted reports whether the event has already been counted in the
+// metrics, and records that it has. Event IDs increase monotonically, so only
+// the highest counted ID is kept. Events without a numeric ID are always
+// counted
+func (f *filter) counted(event boshdir.Event) bool {
+	id, err := strconv.ParseInt(event.ID(), 10, 64)
+	if err != nil {
+		return false
+	}
+
+	if id <= f.countedID {
+		return true
+	}
+
+	f.countedID = id
+	return false
+}
+
+// redact returns the event with the values of any sensitive context keys
+// replaced, along with the number of values which were replaced. The event
+// is returned unchanged when nothing needs to be redacted
+func (f *filter) redact(event boshdir.Event) (boshdir.Event, int) {
+	if len(f.redactKeys) == 0 || len(event.Context()) == 0 {
+		return event, 0
+	}
+
+	context, redacted := f.redactValue(event.Context())
+	if redacted == 0 {
+		return event, 0
+	}
+
+	return boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
+		ID:             event.ID(),
+		ParentID:       event.ParentID(),
+		Timestamp:      event.Timestamp().Unix(),
+		User:           event.User(),
+		Action:         event.Action(),
+		ObjectType:     event.ObjectType(),
+		ObjectName:     event.ObjectName(),
+		TaskID:         event.TaskID(),
+		DeploymentName: event.DeploymentName(),
+		Instance:       event.Instance(),
+		Context:        context.(map[string]interface{}),
+		Error:          event.Error(),
+	}), redacted
+}
+
+// redactValue copies the value, replacing the values of sensitive keys in
+// any nested maps, so the original event is never modified
+func (f *filter) redactValue(value interface{}) (interface{}, int) {
+	redacted := 0
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, nested := range v {
+			if f.redactKeys[strings.ToLower(key)] {
+				copied[key] = redactedValue
+				redacted++
+				continue
+			}
+
+			var n int
+			copied[key], n = f.redactValue(nested)
+			redacted += n
+		}
+		return copied, redacted
+
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, nested := range v {
+			var n int
+			copied[i], n = f.redactValue(nested)
+			redacted += n
+		}
+		return copied, redacted
+
+	default:
+		return value, 0
+	}
+}
+
+func newCriteria(c Criteria) *criteria {
+	if c.isEmpty() {
+		return nil
+	}
+
+	set := func(values []string) map[string]bool {
+		s := make(map[string]bool)
+		for _, value := range values {
+			s[value] = true
+		}
+		return s
+	}
+
+	compiled := &criteria{
+		actions:     set(c.Actions),
+		objectTypes: set(c.ObjectTypes),
+		deployments: set(c.Deployments),
+		users:       set(c.Users),
+	}
+
+	if c.ObjectNameRegex != "" {
+		// The rules have already been validated
+		compiled.objectName = regexp.MustCompile(c.ObjectNameRegex)
+	}
+
+	return compiled
+}
+
+func (c *criteria) matches(event boshdir.Event) bool {
+	matchesSet := func(s map[string]bool, value string) bool {
+		return len(s) == 0 || s[value]
+	}
+
+	return matchesSet(c.actions, event.Action()) &&
+		matchesSet(c.objectTypes, event.ObjectType()) &&
+		matchesSet(c.deployments, event.DeploymentName()) &&
+		matchesSet(c.users, event.User()) &&
+		(c.objectName == nil || c.objectName.MatchString(event.ObjectName()))
+}
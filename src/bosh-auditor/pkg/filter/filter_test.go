@@ -0,0 +1,227 @@
+package filter_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	boshdir "github.com/cloudfoundry/bosh-cli/director"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/filter"
+)
+
+func event(id string, action string, objectType string, objectName string) boshdir.Event {
+	return boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
+		ID:             id,
+		Timestamp:      1234,
+		User:           "some-user",
+		Action:         action,
+		ObjectType:     objectType,
+		ObjectName:     objectName,
+		DeploymentName: "some-deployment",
+	})
+}
+
+func droppedTotal(rule string) float64 {
+	var metric dto.Metric
+	err := filter.FilterEventsDroppedTotal.WithLabelValues(rule).Write(&metric)
+	Expect(err).NotTo(HaveOccurred())
+	return metric.GetCounter().GetValue()
+}
+
+func idsOf(events []boshdir.Event) []string {
+	ids := make([]string, 0)
+	for _, event := range events {
+		ids = append(ids, event.ID())
+	}
+	return ids
+}
+
+var _ = Describe("Filter", func() {
+	var (
+		logger lager.Logger
+		events []boshdir.Event
+	)
+
+	BeforeEach(func() {
+		logger = lager.NewLogger("filter-test")
+		logger.RegisterSink(lager.NewWriterSink(GinkgoWriter, lager.INFO))
+
+		events = []boshdir.Event{
+			event("1", "delete", "deployment", "cf"),
+			event("2", "delete", "vm", "vm-1234"),
+			event("3", "create", "vm", "vm-5678"),
+			event("4", "update", "deployment", "prometheus"),
+		}
+	})
+
+	It("ships every event when there are no rules", func() {
+		f, err := filter.NewFilter(filter.Rules{}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(f.EventsFilter()).To(Equal(boshdir.EventsFilter{}))
+		Expect(f.Apply(events)).To(Equal(events))
+	})
+
+	It("only ships events matching the include rules", func() {
+		f, err := filter.NewFilter(filter.Rules{
+			Include: filter.Criteria{
+				Actions:     []string{"delete", "update"},
+				ObjectTypes: []string{"deployment"},
+			},
+		}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(idsOf(f.Apply(events))).To(Equal([]string{"1", "4"}))
+	})
+
+	It("does not ship events matching the exclude rules", func() {
+		f, err := filter.NewFilter(filter.Rules{
+			Exclude: filter.Criteria{
+				ObjectNameRegex: "^vm-",
+			},
+		}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(idsOf(f.Apply(events))).To(Equal([]string{"1", "4"}))
+	})
+
+	It("lets the director filter when there is a single value to include", func() {
+		f, err := filter.NewFilter(filter.Rules{
+			Include: filter.Criteria{
+				Actions:     []string{"delete"},
+				ObjectTypes: []string{"deployment", "vm"},
+				Deployments: []string{"some-deployment"},
+				Users:       []string{"some-user"},
+			},
+			Exclude: filter.Criteria{
+				Actions: []string{"create"},
+			},
+		}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(f.EventsFilter()).To(Equal(boshdir.EventsFilter{
+			Action:     "delete",
+			Deployment: "some-deployment",
+			User:       "some-user",
+		}))
+	})
+
+	It("redacts sensitive keys from the context", func() {
+		original := map[string]interface{}{
+			"Password": "secret",
+			"user":     "admin",
+			"nested": map[string]interface{}{
+				"token": "secret",
+			},
+			"list": []interface{}{
+				map[string]interface{}{"password": "secret"},
+			},
+		}
+
+		f, err := filter.NewFilter(filter.Rules{
+			RedactContextKeys: []string{"password", "token"},
+		}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		filtered := f.Apply([]boshdir.Event{
+			boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
+				ID:        "1",
+				Timestamp: 1234,
+				Action:    "update",
+				Context:   original,
+			}),
+		})
+
+		Expect(filtered).To(HaveLen(1))
+		Expect(filtered[0].ID()).To(Equal("1"))
+		Expect(filtered[0].Action()).To(Equal("update"))
+		Expect(filtered[0].Timestamp()).To(BeTemporally("==", time.Unix(1234, 0)))
+		Expect(filtered[0].Context()).To(Equal(map[string]interface{}{
+			"Password": "[REDACTED]",
+			"user":     "admin",
+			"nested": map[string]interface{}{
+				"token": "[REDACTED]",
+			},
+			"list": []interface{}{
+				map[string]interface{}{"password": "[REDACTED]"},
+			},
+		}))
+
+		By("not modifying the original event")
+		Expect(original).To(HaveKeyWithValue("Password", "secret"))
+	})
+
+	It("counts each dropped event once", func() {
+		f, err := filter.NewFilter(filter.Rules{
+			Include: filter.Criteria{ObjectTypes: []string{"vm"}},
+		}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		before := droppedTotal("include")
+
+		By("applying the filter for two shippers")
+		Expect(idsOf(f.Apply(events))).To(Equal([]string{"2", "3"}))
+		Expect(idsOf(f.Apply(events))).To(Equal([]string{"2", "3"}))
+		Expect(droppedTotal("include")).To(Equal(before + 2))
+
+		By("applying the filter to a newer event")
+		events = append(events, event("5", "delete", "deployment", "cf"))
+		Expect(idsOf(f.Apply(events))).To(Equal([]string{"2", "3"}))
+		Expect(droppedTotal("include")).To(Equal(before + 3))
+	})
+
+	Context("when loading rules", func() {
+		var tempd string
+
+		BeforeEach(func() {
+			var err error
+			tempd, err = ioutil.TempDir("", "bosh-auditor-filter")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tempd)
+		})
+
+		It("loads rules from JSON", func() {
+			path := filepath.Join(tempd, "filters.json")
+			err := ioutil.WriteFile(path, []byte(`{
+				"include": {"actions": ["delete"], "object_name_regex": "^cf"},
+				"exclude": {"users": ["health_monitor"]},
+				"redact_context_keys": ["password"]
+			}`), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			rules, err := filter.LoadRules(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).To(Equal(filter.Rules{
+				Include: filter.Criteria{
+					Actions:         []string{"delete"},
+					ObjectNameRegex: "^cf",
+				},
+				Exclude: filter.Criteria{
+					Users: []string{"health_monitor"},
+				},
+				RedactContextKeys: []string{"password"},
+			}))
+		})
+
+		It("rejects invalid regular expressions", func() {
+			path := filepath.Join(tempd, "filters.json")
+			err := ioutil.WriteFile(path, []byte(`{
+				"exclude": {"object_name_regex": "("}
+			}`), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = filter.LoadRules(path)
+			Expect(err).To(MatchError(ContainSubstring("exclude.object_name_regex")))
+		})
+	})
+})
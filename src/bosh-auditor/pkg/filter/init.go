@@ -0,0 +1,5 @@
+package filter
+
+func init() {
+	initMetrics()
+}
@@ -0,0 +1,25 @@
+package filter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	FilterEventsDroppedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "bosh_auditor_filter_events_dropped_total",
+			Help: "Counter of total number of bosh events dropped by the filter rules",
+		},
+		[]string{"rule"},
+	)
+
+	FilterContextKeysRedactedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bosh_auditor_filter_context_keys_redacted_total",
+		Help: "Counter of total number of values redacted from the context of bosh events",
+	})
+)
+
+func initMetrics() {
+	prometheus.MustRegister(FilterEventsDroppedTotal)
+	prometheus.MustRegister(FilterContextKeysRedactedTotal)
+}
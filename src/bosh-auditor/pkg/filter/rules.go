@@ -0,0 +1,80 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+)
+
+// Criteria matches an event when every non-empty field matches. Within a
+// field the event only needs to match one of the values
+type Criteria struct {
+	Actions         []string `json:"actions"`
+	ObjectTypes     []string `json:"object_types"`
+	Deployments     []string `json:"deployments"`
+	Users           []string `json:"users"`
+	ObjectNameRegex string   `json:"object_name_regex"`
+}
+
+// Rules decide which events are shipped, and which keys are redacted from
+// the context of the events which are shipped. An event is shipped when it
+// matches Include, or Include is empty, and does not match Exclude
+type Rules struct {
+	Include           Criteria `json:"include"`
+	Exclude           Criteria `json:"exclude"`
+	RedactContextKeys []string `json:"redact_context_keys"`
+}
+
+func LoadRules(path string) (Rules, error) {
+	var rules Rules
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return rules, err
+	}
+
+	err = json.Unmarshal(contents, &rules)
+	if err != nil {
+		return rules, fmt.Errorf("Could not parse filter rules %s: %s", path, err)
+	}
+
+	err = rules.Validate()
+	if err != nil {
+		return rules, err
+	}
+
+	return rules, nil
+}
+
+func (r Rules) Validate() error {
+	for name, criteria := range map[string]Criteria{
+		"include": r.Include,
+		"exclude": r.Exclude,
+	} {
+		if criteria.ObjectNameRegex == "" {
+			continue
+		}
+
+		_, err := regexp.Compile(criteria.ObjectNameRegex)
+		if err != nil {
+			return fmt.Errorf("Invalid %s.object_name_regex: %s", name, err)
+		}
+	}
+
+	for _, key := range r.RedactContextKeys {
+		if key == "" {
+			return fmt.Errorf("Invalid redact_context_keys: keys must not be empty")
+		}
+	}
+
+	return nil
+}
+
+func (c Criteria) isEmpty() bool {
+	return len(c.Actions) == 0 &&
+		len(c.ObjectTypes) == 0 &&
+		len(c.Deployments) == 0 &&
+		len(c.Users) == 0 &&
+		c.ObjectNameRegex == ""
+}
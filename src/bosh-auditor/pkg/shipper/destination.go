@@ -0,0 +1,94 @@
+package shipper
+
+import (
+	"time"
+
+	boshdir "github.com/cloudfoundry/bosh-cli/director"
+	"github.com/gojektech/heimdall"
+	"github.com/gojektech/heimdall/httpclient"
+)
+
+// Destination is somewhere to which bosh events are shipped
+type Destination interface {
+	// Name is used to name the cursor and label the metrics of the
+	// destination, so it must be unique and must not change
+	Name() string
+
+	// Ship ships the events in order. It returns the number of events, from
+	// the start of the slice, which were shipped successfully, so that the
+	// cursor can be advanced past them even when a later event fails
+	Ship([]boshdir.Event) (int, error)
+}
+
+// batch is a group of events which are shipped to a destination in a single
+// request, along with each event serialised by the destination
+type batch struct {
+	events   []boshdir.Event
+	payloads [][]byte
+	size     int
+}
+
+// batchEvents groups the events, in order, into batches of at most maxEvents
+// events and maxBytes bytes of payload. An event which is larger than
+// maxBytes by itself is shipped in a batch of its own
+func batchEvents(
+	events []boshdir.Event,
+	marshal func(boshdir.Event) ([]byte, error),
+	maxEvents int,
+	maxBytes int,
+) ([]batch, error) {
+	batches := make([]batch, 0)
+	current := batch{}
+
+	for _, event := range events {
+		payload, err := marshal(event)
+		if err != nil {
+			return nil, err
+		}
+
+		full := len(current.events) >= maxEvents ||
+			current.size+len(payload)+1 > maxBytes
+
+		if len(current.events) > 0 && full {
+			batches = append(batches, current)
+			current = batch{}
+		}
+
+		current.events = append(current.events, event)
+		current.payloads = append(current.payloads, payload)
+		current.size += len(payload) + 1
+	}
+
+	if len(current.events) > 0 {
+		batches = append(batches, current)
+	}
+
+	return batches, nil
+}
+
+// newRetryingHTTPClient wraps the doer, which usually sets authentication
+// headers, with retries and exponential backoff
+func newRetryingHTTPClient(doer heimdall.Doer) *httpclient.Client {
+	var (
+		requestTimeout         = 2 * time.Second
+		initalTimeout          = 100 * time.Millisecond
+		maxTimeout             = 2 * time.Second
+		exponent       float64 = 2
+		jitter                 = 500 * time.Millisecond
+		maxRetries             = 3
+
+		backoff = heimdall.NewExponentialBackoff(
+			initalTimeout, maxTimeout,
+			exponent, jitter,
+		)
+
+		retrier = heimdall.NewRetrier(backoff)
+	)
+
+	return httpclient.NewClient(
+		httpclient.WithHTTPClient(doer),
+		httpclient.WithHTTPTimeout(requestTimeout),
+		httpclient.WithRetrier(retrier),
+		httpclient.WithRetryCount(maxRetries),
+	)
+}
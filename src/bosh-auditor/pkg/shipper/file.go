@@ -0,0 +1,63 @@
+package shipper
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	boshdir "github.com/cloudfoundry/bosh-cli/director"
+)
+
+type fileDestination struct {
+	deployEnv string
+	path      string
+}
+
+// NewFileDestination appends events to a local file as newline-delimited
+// JSON, which is useful for log forwarders which tail files
+func NewFileDestination(
+	deployEnv string,
+	path string,
+) Destination {
+	return &fileDestination{
+		deployEnv,
+		path,
+	}
+}
+
+func (d *fileDestination) Name() string {
+	return "file"
+}
+
+// Ship writes all of the events with a single write and syncs the file, an
+// event only counts as shipped once it is on disk
+func (d *fileDestination) Ship(events []boshdir.Event) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+
+	for _, event := range events {
+		if err := encoder.Encode(newAuditEvent(d.deployEnv, event)); err != nil {
+			return 0, err
+		}
+	}
+
+	file, err := os.OpenFile(d.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+
+	return len(events), nil
+}
@@ -0,0 +1,85 @@
+package shipper_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	boshdir "github.com/cloudfoundry/bosh-cli/director"
+
+	s "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/shipper"
+)
+
+var _ = Describe("FileDestination", func() {
+	var (
+		err   error
+		tempd string
+	)
+
+	BeforeEach(func() {
+		tempd, err = ioutil.TempDir("", "file-destination-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		if tempd != "" {
+			os.RemoveAll(tempd)
+		}
+	})
+
+	readEvents := func(path string) []s.AuditEvent {
+		file, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+
+		events := make([]s.AuditEvent, 0)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event s.AuditEvent
+			err := json.Unmarshal(scanner.Bytes(), &event)
+			Expect(err).NotTo(HaveOccurred())
+			events = append(events, event)
+		}
+		Expect(scanner.Err()).NotTo(HaveOccurred())
+
+		return events
+	}
+
+	It("should append events as newline delimited JSON", func() {
+		path := filepath.Join(tempd, "events.ndjson")
+		destination := s.NewFileDestination("dev", path)
+		Expect(destination.Name()).To(Equal("file"))
+
+		for _, id := range []string{"1", "2"} {
+			shipped, err := destination.Ship([]boshdir.Event{
+				boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
+					ID:        id,
+					Timestamp: 1234,
+				}),
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shipped).To(Equal(1))
+		}
+
+		events := readEvents(path)
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Source).To(Equal("dev"))
+		Expect(events[0].Event.ID).To(Equal("1"))
+		Expect(events[1].Event.ID).To(Equal("2"))
+	})
+
+	It("should return an error when the file cannot be written", func() {
+		destination := s.NewFileDestination("dev", "/path/does/not/exist/events.ndjson")
+
+		shipped, err := destination.Ship([]boshdir.Event{
+			boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{ID: "1"}),
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(shipped).To(Equal(0))
+	})
+})
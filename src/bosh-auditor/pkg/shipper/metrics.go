@@ -9,8 +9,47 @@ var (
 		Name: "bosh_auditor_events_shipped_to_splunk_total",
 		Help: "Counter of total number of bosh events shipped_to_splunk",
 	})
+
+	DestinationEventsShippedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bosh_auditor_destination_events_shipped_total",
+		Help: "Counter of total number of bosh events shipped to each destination",
+	}, []string{"destination"})
+
+	ShipErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bosh_auditor_destination_ship_errors_total",
+		Help: "Counter of total number of failures shipping bosh events to each destination",
+	}, []string{"destination"})
+
+	BatchErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "bosh_auditor_splunk_batch_errors_total",
+		Help: "Counter of total number of batches of bosh events which failed to ship to splunk",
+	})
+
+	BatchSizeEvents = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bosh_auditor_splunk_batch_size_events",
+		Help:    "Histogram of the number of bosh events in each batch shipped to splunk",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 11),
+	})
+
+	BatchSizeBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bosh_auditor_splunk_batch_size_bytes",
+		Help:    "Histogram of the size in bytes of each batch shipped to splunk",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+	})
+
+	RequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bosh_auditor_splunk_request_duration_seconds",
+		Help:    "Histogram of the duration of requests shipping batches to splunk, including retries",
+		Buckets: prometheus.DefBuckets,
+	})
 )
 
 func initMetrics() {
 	prometheus.MustRegister(EventsShippedTotal)
+	prometheus.MustRegister(DestinationEventsShippedTotal)
+	prometheus.MustRegister(ShipErrorsTotal)
+	prometheus.MustRegister(BatchErrorsTotal)
+	prometheus.MustRegister(BatchSizeEvents)
+	prometheus.MustRegister(BatchSizeBytes)
+	prometheus.MustRegister(RequestDuration)
 }
@@ -1,48 +1,31 @@
 package shipper
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"net/http"
+	"strconv"
 	"time"
 
 	"code.cloudfoundry.org/lager"
 	boshdir "github.com/cloudfoundry/bosh-cli/director"
-	"github.com/gojektech/heimdall"
-	"github.com/gojektech/heimdall/httpclient"
 
 	c "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/cursor"
 	f "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/fetcher"
+	fl "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/filter"
 )
 
 type BoshEvent struct {
-	ID             string `json:"id"`
-	Timestamp      int64  `json:"timestamp"`
-	User           string `json:"user"`
-	Action         string `json:"action"`
-	TaskID         string `json:"task"`
-	DeploymentName string `json:"deployment"`
-	Instance       string `json:"instance"`
-}
-
-type SplunkEvent struct {
-	SourceType string    `json:"sourcetype"`
-	Source     string    `json:"source"`
-	Event      BoshEvent `json:"event"`
-}
-
-type splunkHTTPClient struct {
-	client       http.Client
-	splunkAPIKey string
-}
-
-func (c *splunkHTTPClient) Do(req *http.Request) (*http.Response, error) {
-	req.Header.Set("Authorization", fmt.Sprintf("Splunk %s", c.splunkAPIKey))
-	req.Header.Set("Content-Type", "application/json")
-	return c.client.Do(req)
+	ID             string                 `json:"id"`
+	ParentID       string                 `json:"parent_id"`
+	Timestamp      int64                  `json:"timestamp"`
+	User           string                 `json:"user"`
+	Action         string                 `json:"action"`
+	ObjectType     string                 `json:"object_type"`
+	ObjectName     string                 `json:"object_name"`
+	TaskID         string                 `json:"task"`
+	DeploymentName string                 `json:"deployment"`
+	Instance       string                 `json:"instance"`
+	Context        map[string]interface{} `json:"context"`
+	Error          string                 `json:"error"`
 }
 
 type Shipper interface {
@@ -50,52 +33,30 @@ type Shipper interface {
 }
 
 type shipper struct {
-	schedule  time.Duration
-	logger    lager.Logger
-	cursor    c.Cursor
-	fetcher   f.Fetcher
-	deployEnv string
-	client    *httpclient.Client
-	splunkURL string
+	schedule    time.Duration
+	logger      lager.Logger
+	cursor      c.Cursor
+	fetcher     f.Fetcher
+	filter      fl.Filter
+	destination Destination
 
 	eventsShipped int
 }
 
+// NewShipper returns a shipper which ships the fetched events accepted by
+// the filter to the destination. The filter may be nil, in which case every
+// event is shipped
 func NewShipper(
 	schedule time.Duration,
 	logger lager.Logger,
 	cursor c.Cursor,
 	fetcher f.Fetcher,
-	deployEnv string,
-	splunkAPIKey string,
-	splunkURL string,
+	filter fl.Filter,
+	destination Destination,
 ) Shipper {
-	logger = logger.Session("bosh-events-to-splunk-shipper")
-
-	var (
-		requestTimeout         = 2 * time.Second
-		initalTimeout          = 100 * time.Millisecond
-		maxTimeout             = 2 * time.Second
-		exponent       float64 = 2
-		jitter                 = 500 * time.Millisecond
-		maxRetries             = 3
-
-		backoff = heimdall.NewExponentialBackoff(
-			initalTimeout, maxTimeout,
-			exponent, jitter,
-		)
-
-		retrier = heimdall.NewRetrier(backoff)
-	)
-
-	client := httpclient.NewClient(
-		httpclient.WithHTTPClient(&splunkHTTPClient{
-			client:       *http.DefaultClient,
-			splunkAPIKey: splunkAPIKey,
-		}),
-		httpclient.WithHTTPTimeout(requestTimeout),
-		httpclient.WithRetrier(retrier),
-		httpclient.WithRetryCount(maxRetries),
+	logger = logger.Session(
+		"bosh-events-shipper",
+		lager.Data{"destination": destination.Name()},
 	)
 
 	return &shipper{
@@ -103,9 +64,8 @@ func NewShipper(
 		logger,
 		cursor,
 		fetcher,
-		deployEnv,
-		client,
-		splunkURL,
+		filter,
+		destination,
 		0,
 	}
 }
@@ -113,53 +73,36 @@ func NewShipper(
 func convertEvent(event boshdir.Event) BoshEvent {
 	return BoshEvent{
 		ID:             event.ID(),
+		ParentID:       event.ParentID(),
 		Timestamp:      event.Timestamp().Unix(),
 		User:           event.User(),
 		Action:         event.Action(),
+		ObjectType:     event.ObjectType(),
+		ObjectName:     event.ObjectName(),
 		TaskID:         event.TaskID(),
 		DeploymentName: event.DeploymentName(),
 		Instance:       event.Instance(),
+		Context:        event.Context(),
+		Error:          event.Error(),
 	}
 }
 
-func (s *shipper) shipEvent(event boshdir.Event) error {
-	bytesToShip, err := json.Marshal(SplunkEvent{
-		SourceType: "bosh-audit-event",
-		Source:     s.deployEnv,
-		Event:      convertEvent(event),
-	})
-
-	if err != nil {
-		return err
-	}
-
-	resp, err := s.client.Post(
-		s.splunkURL,
-		bytes.NewReader(bytesToShip),
-		http.Header{},
-	)
-
-	defer func() {
-		if resp.Body != nil {
-			resp.Body.Close()
+// alreadyShipped reports whether the event is at or before the cursor
+// position. Event IDs increase monotonically, so when the cursor has an event
+// ID we compare IDs, which is exact even when many events share a second.
+// Cursors without an event ID only know the time, so we ship events from that
+// second again rather than risk dropping them
+func alreadyShipped(position c.Position, event boshdir.Event) bool {
+	if position.EventID != "" {
+		positionID, perr := strconv.ParseInt(position.EventID, 10, 64)
+		eventID, eerr := strconv.ParseInt(event.ID(), 10, 64)
+
+		if perr == nil && eerr == nil {
+			return eventID <= positionID
 		}
-	}()
-
-	if err != nil {
-		return err
-	}
-
-	if 200 <= resp.StatusCode && resp.StatusCode < 300 {
-		return nil
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-
-	if err != nil {
-		return err
-	}
-
-	return fmt.Errorf("Status: %d Body: %s", resp.StatusCode, body)
+	return event.Timestamp().Before(position.Time)
 }
 
 func (s *shipper) Run(ctx context.Context) error {
@@ -168,6 +111,8 @@ func (s *shipper) Run(ctx context.Context) error {
 	lsession.Info("start")
 	defer lsession.Info("end")
 
+	destinationName := s.destination.Name()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -176,8 +121,12 @@ func (s *shipper) Run(ctx context.Context) error {
 		case <-time.After(s.schedule):
 			startTime := time.Now()
 
-			latestEventTimestamp := s.cursor.GetTime()
-			eventsToShip, err := s.fetcher(latestEventTimestamp)
+			position := s.cursor.GetPosition()
+
+			// We ask for events from the second before the cursor, so that
+			// we see every event sharing a second with the cursor regardless
+			// of whether the director treats after_time as inclusive
+			eventsToShip, err := s.fetcher(position.Time.Add(-1 * time.Second))
 
 			if err != nil {
 				lsession.Error("err-get-unshipped-bosh-audit-events-for-shipper", err)
@@ -185,30 +134,62 @@ func (s *shipper) Run(ctx context.Context) error {
 			}
 
 			var (
-				shippedEvents    = make([]boshdir.Event, 0)
-				allEventsShipped = true
+				skippedEvents   = 0
+				unshippedEvents = make([]boshdir.Event, 0)
+				latestPosition  = position
 			)
 
 			for _, event := range eventsToShip {
-				err := s.shipEvent(event)
-
-				if err != nil {
-					lsession.Error("err-ship-event", err)
-					allEventsShipped = false
-					break
+				if alreadyShipped(position, event) {
+					skippedEvents++
+					continue
 				}
 
-				if event.Timestamp().After(latestEventTimestamp) {
-					latestEventTimestamp = event.Timestamp()
+				unshippedEvents = append(unshippedEvents, event)
+			}
+
+			fetchedEvents := unshippedEvents
+			if s.filter != nil {
+				unshippedEvents = s.filter.Apply(fetchedEvents)
+			}
+
+			// The destination reports how many events, from the start, it
+			// has durably shipped, so the cursor only advances past those
+			shipped, err := s.destination.Ship(unshippedEvents)
+			if err != nil {
+				lsession.Error("err-ship-events", err, lager.Data{
+					"events-shipped":   shipped,
+					"events-unshipped": len(unshippedEvents) - shipped,
+				})
+				ShipErrorsTotal.WithLabelValues(destinationName).Inc()
+			}
+
+			if shipped > 0 {
+				lastEvent := unshippedEvents[shipped-1]
+				latestPosition = c.Position{
+					Time:    lastEvent.Timestamp(),
+					EventID: lastEvent.ID(),
 				}
 
-				shippedEvents = append(shippedEvents, event)
-				s.eventsShipped++
-				EventsShippedTotal.Inc()
+				s.eventsShipped += shipped
+				DestinationEventsShippedTotal.WithLabelValues(destinationName).Add(float64(shipped))
 			}
 
-			if err = s.cursor.UpdateTime(latestEventTimestamp); err != nil {
-				lsession.Error("err-update-shipper-cursor", err)
+			// When every event accepted by the filter has been shipped, the
+			// cursor also moves past the events the filter dropped, so that
+			// they are not fetched again on every tick
+			if err == nil && shipped == len(unshippedEvents) && len(fetchedEvents) > 0 {
+				lastEvent := fetchedEvents[len(fetchedEvents)-1]
+				latestPosition = c.Position{
+					Time:    lastEvent.Timestamp(),
+					EventID: lastEvent.ID(),
+				}
+			}
+
+			if latestPosition != position {
+				if err = s.cursor.UpdatePosition(latestPosition); err != nil {
+					lsession.Error("err-update-shipper-cursor", err)
+				}
 			}
 
 			duration := time.Since(startTime)
@@ -216,9 +197,11 @@ func (s *shipper) Run(ctx context.Context) error {
 				"shipped-events",
 				lager.Data{
 					"duration":             duration,
-					"events-shipped":       len(shippedEvents),
+					"events-shipped":       shipped,
+					"events-skipped":       skippedEvents,
+					"events-dropped":       len(fetchedEvents) - len(unshippedEvents),
 					"total-events-shipped": s.eventsShipped,
-					"all-events-shipped":   allEventsShipped,
+					"all-events-shipped":   shipped == len(unshippedEvents),
 				},
 			)
 		}
@@ -7,6 +7,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,9 +19,11 @@ import (
 
 	boshdir "github.com/cloudfoundry/bosh-cli/director"
 	"github.com/jarcoal/httpmock"
+	dto "github.com/prometheus/client_model/go"
 
 	c "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/cursor"
 	f "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/fetcher"
+	fl "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/filter"
 	s "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/shipper"
 )
 
@@ -78,31 +82,46 @@ var _ = Describe("Shipper", func() {
 		fetcher = func(t time.Time) ([]boshdir.Event, error) {
 			return []boshdir.Event{
 				boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
-					ID:             "abcd",
+					ID:             "1",
+					ParentID:       "some-parent",
 					Timestamp:      1234,
 					User:           "some-user",
 					Action:         "some-action",
+					ObjectType:     "some-object-type",
+					ObjectName:     "some-object-name",
 					TaskID:         "some-task",
 					DeploymentName: "some-deployment",
 					Instance:       "some-instance",
+					Context:        map[string]interface{}{"some-key": "some-value"},
+					Error:          "some-error",
 				}),
 				boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
-					ID:             "efgh",
+					ID:             "2",
+					ParentID:       "some-parent",
 					Timestamp:      1235,
 					User:           "some-user",
 					Action:         "some-action",
+					ObjectType:     "some-object-type",
+					ObjectName:     "some-object-name",
 					TaskID:         "some-task",
 					DeploymentName: "some-deployment",
 					Instance:       "some-instance",
+					Context:        map[string]interface{}{"some-key": "some-value"},
+					Error:          "some-error",
 				}),
 				boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
-					ID:             "ijkl",
+					ID:             "3",
+					ParentID:       "some-parent",
 					Timestamp:      1236,
 					User:           "some-user",
 					Action:         "some-action",
+					ObjectType:     "some-object-type",
+					ObjectName:     "some-object-name",
 					TaskID:         "some-task",
 					DeploymentName: "some-deployment",
 					Instance:       "some-instance",
+					Context:        map[string]interface{}{"some-key": "some-value"},
+					Error:          "some-error",
 				}),
 			}, nil
 		}
@@ -112,42 +131,54 @@ var _ = Describe("Shipper", func() {
 			logger,
 			cursor,
 			fetcher,
-			"dev", "splunk-key", splunkURL,
+			nil,
+			s.NewSplunkDestination("dev", "bosh.dev", "splunk-key", splunkURL, 2, 1024*1024),
 		)
 
+		eventsReceived := 0
+
 		httpmock.RegisterResponder(
 			"POST", splunkURL,
 			func(req *http.Request) (*http.Response, error) {
-				body, err := ioutil.ReadAll(req.Body)
-				Expect(err).NotTo(HaveOccurred())
-
-				var event s.SplunkEvent
-				err = json.Unmarshal(body, &event)
-				Expect(err).NotTo(HaveOccurred())
-
-				Expect(event).To(MatchAllFields(Fields{
-					"SourceType": Equal("bosh-audit-event"),
-					"Source":     Equal("dev"),
-					"Event": MatchAllFields(Fields{
-						"ID": Or(
-							Equal("abcd"),
-							Equal("efgh"),
-							Equal("ijkl"),
-						),
-
-						"Timestamp": Or(
-							BeNumerically("==", int64(1234)),
-							BeNumerically("==", int64(1235)),
-							BeNumerically("==", int64(1236)),
-						),
-
-						"User":           Equal("some-user"),
-						"Action":         Equal("some-action"),
-						"TaskID":         Equal("some-task"),
-						"DeploymentName": Equal("some-deployment"),
-						"Instance":       Equal("some-instance"),
-					}),
-				}))
+				decoder := json.NewDecoder(req.Body)
+
+				for decoder.More() {
+					var event s.SplunkEvent
+					err := decoder.Decode(&event)
+					Expect(err).NotTo(HaveOccurred())
+					eventsReceived++
+
+					Expect(event).To(MatchAllFields(Fields{
+						"Time":       Equal(event.Event.Timestamp),
+						"Host":       Equal("bosh.dev"),
+						"SourceType": Equal("bosh-audit-event"),
+						"Source":     Equal("dev"),
+						"Event": MatchAllFields(Fields{
+							"ID": Or(
+								Equal("1"),
+								Equal("2"),
+								Equal("3"),
+							),
+
+							"Timestamp": Or(
+								BeNumerically("==", int64(1234)),
+								BeNumerically("==", int64(1235)),
+								BeNumerically("==", int64(1236)),
+							),
+
+							"ParentID":       Equal("some-parent"),
+							"User":           Equal("some-user"),
+							"Action":         Equal("some-action"),
+							"ObjectType":     Equal("some-object-type"),
+							"ObjectName":     Equal("some-object-name"),
+							"TaskID":         Equal("some-task"),
+							"DeploymentName": Equal("some-deployment"),
+							"Instance":       Equal("some-instance"),
+							"Context":        HaveKeyWithValue("some-key", "some-value"),
+							"Error":          Equal("some-error"),
+						}),
+					}))
+				}
 
 				return httpmock.NewJsonResponse(200, map[string]interface{}{
 					"message": "success",
@@ -172,20 +203,27 @@ var _ = Describe("Shipper", func() {
 			shipWG.Done()
 		}()
 
-		By("waiting for events to be shipped")
+		By("waiting for events to be shipped in batches")
 		Eventually(
 			httpmock.GetTotalCallCount, "1000ms", "1ms",
-		).Should(BeNumerically("==", 3))
+		).Should(BeNumerically("==", 2))
 
-		Expect(shipError).NotTo(HaveOccurred())
+		By("checking the events are not shipped again")
+		Consistently(
+			httpmock.GetTotalCallCount, "50ms", "1ms",
+		).Should(BeNumerically("==", 2))
 
 		By("checking the cursor was updated")
-		Expect(cursor.GetTime()).To(BeTemporally("~", time.Unix(1236, 0)))
+		Expect(cursor.GetPosition().Time).To(BeTemporally("~", time.Unix(1236, 0)))
+		Expect(cursor.GetPosition().EventID).To(Equal("3"))
 
 		By("cleaning up")
 		cancelShip()
 		shipWG.Wait()
 		Expect(shipError).NotTo(HaveOccurred())
+
+		By("checking every event was received")
+		Expect(eventsReceived).To(Equal(3))
 	})
 
 	It("is resilient to errors", func() {
@@ -200,7 +238,7 @@ var _ = Describe("Shipper", func() {
 
 			return []boshdir.Event{
 				boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
-					ID:             "abcd",
+					ID:             strconv.Itoa(fetcherCallCount),
 					Timestamp:      int64(fetcherCallCount),
 					User:           "some-user",
 					Action:         "some-action",
@@ -216,7 +254,8 @@ var _ = Describe("Shipper", func() {
 			logger,
 			cursor,
 			fetcher,
-			"dev", "splunk-key", splunkURL,
+			nil,
+			s.NewSplunkDestination("dev", "bosh.dev", "splunk-key", splunkURL, 100, 1024*1024),
 		)
 
 		httpmock.RegisterResponder(
@@ -230,16 +269,23 @@ var _ = Describe("Shipper", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				Expect(event).To(MatchAllFields(Fields{
+					"Time":       Equal(event.Event.Timestamp),
+					"Host":       Equal("bosh.dev"),
 					"SourceType": Equal("bosh-audit-event"),
 					"Source":     Equal("dev"),
 					"Event": MatchAllFields(Fields{
-						"ID":             Equal("abcd"),
+						"ID":             Not(BeEmpty()),
+						"ParentID":       BeEmpty(),
 						"Timestamp":      BeAssignableToTypeOf(int64(0)),
 						"User":           Equal("some-user"),
 						"Action":         Equal("some-action"),
+						"ObjectType":     BeEmpty(),
+						"ObjectName":     BeEmpty(),
 						"TaskID":         Equal("some-task"),
 						"DeploymentName": Equal("some-deployment"),
 						"Instance":       Equal("some-instance"),
+						"Context":        BeEmpty(),
+						"Error":          BeEmpty(),
 					}),
 				}))
 
@@ -271,10 +317,286 @@ var _ = Describe("Shipper", func() {
 			httpmock.GetTotalCallCount, "1000ms", "1ms",
 		).Should(BeNumerically("==", 5))
 
+		By("checking the cursor was updated")
+		Expect(cursor.GetPosition().Time).To(BeTemporally("~", time.Unix(5+1, 0)))
+		Expect(cursor.GetPosition().EventID).To(Equal("6"))
+
+		By("cleaning up")
+		cancelShip()
+		shipWG.Wait()
 		Expect(shipError).NotTo(HaveOccurred())
+	})
+
+	It("ships events sharing a second with the cursor exactly once", func() {
+		err = cursor.UpdatePosition(c.Position{Time: time.Unix(1234, 0), EventID: "2"})
+		Expect(err).NotTo(HaveOccurred())
+
+		var fetchedAfter time.Time
+
+		fetcher = func(t time.Time) ([]boshdir.Event, error) {
+			fetchedAfter = t
+
+			events := make([]boshdir.Event, 0)
+			for _, id := range []string{"1", "2", "3", "4"} {
+				events = append(events, boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
+					ID:        id,
+					Timestamp: 1234,
+				}))
+			}
+			return events, nil
+		}
+
+		shipper = s.NewShipper(
+			10*time.Millisecond,
+			logger,
+			cursor,
+			fetcher,
+			nil,
+			s.NewSplunkDestination("dev", "bosh.dev", "splunk-key", splunkURL, 100, 1024*1024),
+		)
+
+		shippedIDs := make(chan string, 10)
+
+		httpmock.RegisterResponder(
+			"POST", splunkURL,
+			func(req *http.Request) (*http.Response, error) {
+				decoder := json.NewDecoder(req.Body)
+
+				for decoder.More() {
+					var event s.SplunkEvent
+					err := decoder.Decode(&event)
+					Expect(err).NotTo(HaveOccurred())
+
+					shippedIDs <- event.Event.ID
+				}
+
+				return httpmock.NewJsonResponse(200, map[string]interface{}{
+					"message": "success",
+				})
+			},
+		)
+
+		var (
+			shipError error
+			shipWG    sync.WaitGroup
+		)
+
+		shipContext, cancelShip := context.WithTimeout(
+			context.Background(), 100*time.Millisecond,
+		)
+
+		By("running the shipper")
+		shipWG.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			shipError = shipper.Run(shipContext)
+			shipWG.Done()
+		}()
+
+		By("waiting for the unshipped events to be shipped once")
+		Eventually(shippedIDs, "1000ms", "1ms").Should(Receive(Equal("3")))
+		Eventually(shippedIDs, "1000ms", "1ms").Should(Receive(Equal("4")))
+		Consistently(shippedIDs, "50ms", "1ms").ShouldNot(Receive())
+
+		By("checking the fetcher looked back past the cursor second")
+		Expect(fetchedAfter).To(BeTemporally("<", time.Unix(1234, 0)))
 
 		By("checking the cursor was updated")
-		Expect(cursor.GetTime()).To(BeTemporally("~", time.Unix(5+1, 0)))
+		Expect(cursor.GetPosition().EventID).To(Equal("4"))
+
+		By("cleaning up")
+		cancelShip()
+		shipWG.Wait()
+		Expect(shipError).NotTo(HaveOccurred())
+	})
+
+	It("only advances the cursor to the last acknowledged batch", func() {
+		fetcher = func(t time.Time) ([]boshdir.Event, error) {
+			events := make([]boshdir.Event, 0)
+			for i, id := range []string{"1", "2", "3", "4"} {
+				events = append(events, boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
+					ID:        id,
+					Timestamp: int64(1234 + i),
+				}))
+			}
+			return events, nil
+		}
+
+		shipper = s.NewShipper(
+			10*time.Millisecond,
+			logger,
+			cursor,
+			fetcher,
+			nil,
+			s.NewSplunkDestination("dev", "bosh.dev", "splunk-key", splunkURL, 2, 1024*1024),
+		)
+
+		httpmock.RegisterResponder(
+			"POST", splunkURL,
+			func(req *http.Request) (*http.Response, error) {
+				body, err := ioutil.ReadAll(req.Body)
+				Expect(err).NotTo(HaveOccurred())
+
+				if strings.Contains(string(body), `"id":"3"`) {
+					return httpmock.NewStringResponse(400, "Invalid data format"), nil
+				}
+
+				return httpmock.NewJsonResponse(200, map[string]interface{}{
+					"message": "success",
+				})
+			},
+		)
+
+		var (
+			shipError error
+			shipWG    sync.WaitGroup
+		)
+
+		shipContext, cancelShip := context.WithTimeout(
+			context.Background(), 100*time.Millisecond,
+		)
+
+		By("running the shipper")
+		shipWG.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			shipError = shipper.Run(shipContext)
+			shipWG.Done()
+		}()
+
+		By("waiting for the failing batch to be retried")
+		Eventually(
+			httpmock.GetTotalCallCount, "1000ms", "1ms",
+		).Should(BeNumerically(">=", 3))
+
+		By("checking the cursor only includes the acknowledged batch")
+		Expect(cursor.GetPosition().EventID).To(Equal("2"))
+
+		By("cleaning up")
+		cancelShip()
+		shipWG.Wait()
+		Expect(shipError).NotTo(HaveOccurred())
+	})
+
+	It("limits the size of batches in bytes", func() {
+		fetcher = func(t time.Time) ([]boshdir.Event, error) {
+			events := make([]boshdir.Event, 0)
+			for _, id := range []string{"1", "2", "3"} {
+				events = append(events, boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
+					ID:        id,
+					Timestamp: 1234,
+				}))
+			}
+			return events, nil
+		}
+
+		shipper = s.NewShipper(
+			10*time.Millisecond,
+			logger,
+			cursor,
+			fetcher,
+			nil,
+			s.NewSplunkDestination("dev", "bosh.dev", "splunk-key", splunkURL, 100, 1),
+		)
+
+		httpmock.RegisterResponder(
+			"POST", splunkURL,
+			httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+				"message": "success",
+			}),
+		)
+
+		shipContext, cancelShip := context.WithTimeout(
+			context.Background(), 100*time.Millisecond,
+		)
+		defer cancelShip()
+
+		By("running the shipper")
+		go func() {
+			defer GinkgoRecover()
+			shipper.Run(shipContext)
+		}()
+
+		By("waiting for each event to be shipped by itself")
+		Eventually(
+			httpmock.GetTotalCallCount, "1000ms", "1ms",
+		).Should(BeNumerically("==", 3))
+		Eventually(
+			func() string { return cursor.GetPosition().EventID }, "1000ms", "1ms",
+		).Should(Equal("3"))
+	})
+
+	It("advances the cursor past events dropped by the filter", func() {
+		filter, err := fl.NewFilter(fl.Rules{
+			Include: fl.Criteria{Actions: []string{"delete"}},
+		}, logger)
+		Expect(err).NotTo(HaveOccurred())
+
+		droppedTotal := func() float64 {
+			var metric dto.Metric
+			err := fl.FilterEventsDroppedTotal.WithLabelValues("include").Write(&metric)
+			Expect(err).NotTo(HaveOccurred())
+			return metric.GetCounter().GetValue()
+		}
+		droppedBefore := droppedTotal()
+
+		fetcher = func(t time.Time) ([]boshdir.Event, error) {
+			events := make([]boshdir.Event, 0)
+			for i, action := range []string{"delete", "update", "update"} {
+				timestamp := int64(1234 + i)
+				if !time.Unix(timestamp, 0).After(t) {
+					continue
+				}
+
+				events = append(events, boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
+					ID:        strconv.Itoa(i + 1),
+					Timestamp: timestamp,
+					Action:    action,
+				}))
+			}
+			return events, nil
+		}
+
+		shipper = s.NewShipper(
+			10*time.Millisecond,
+			logger,
+			cursor,
+			fetcher,
+			filter,
+			s.NewSplunkDestination("dev", "bosh.dev", "splunk-key", splunkURL, 100, 1024*1024),
+		)
+
+		httpmock.RegisterResponder(
+			"POST", splunkURL,
+			httpmock.NewJsonResponderOrPanic(200, map[string]interface{}{
+				"message": "success",
+			}),
+		)
+
+		var (
+			shipError error
+			shipWG    sync.WaitGroup
+		)
+
+		shipContext, cancelShip := context.WithCancel(context.Background())
+
+		By("running the shipper")
+		shipWG.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			shipError = shipper.Run(shipContext)
+			shipWG.Done()
+		}()
+
+		By("waiting for the cursor to move past the dropped events")
+		Eventually(
+			func() string { return cursor.GetPosition().EventID }, "1000ms", "1ms",
+		).Should(Equal("3"))
+		Expect(cursor.GetPosition().Time).To(BeTemporally("~", time.Unix(1236, 0)))
+
+		By("checking the dropped events are only counted once over many ticks")
+		Consistently(droppedTotal, "100ms", "1ms").Should(Equal(droppedBefore + 2))
+		Expect(httpmock.GetTotalCallCount()).To(Equal(1))
 
 		By("cleaning up")
 		cancelShip()
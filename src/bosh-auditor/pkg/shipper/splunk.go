@@ -0,0 +1,151 @@
+package shipper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	boshdir "github.com/cloudfoundry/bosh-cli/director"
+	"github.com/gojektech/heimdall/httpclient"
+)
+
+// SplunkEvent is an event in the format expected by the HTTP Event Collector.
+// Time is set from the event so that Splunk does not use the time at which
+// it received the event, and Host is the BOSH director
+type SplunkEvent struct {
+	Time       int64     `json:"time"`
+	Host       string    `json:"host"`
+	SourceType string    `json:"sourcetype"`
+	Source     string    `json:"source"`
+	Event      BoshEvent `json:"event"`
+}
+
+type splunkHTTPClient struct {
+	client       http.Client
+	splunkAPIKey string
+}
+
+func (c *splunkHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", fmt.Sprintf("Splunk %s", c.splunkAPIKey))
+	req.Header.Set("Content-Type", "application/json")
+	return c.client.Do(req)
+}
+
+type splunkDestination struct {
+	deployEnv string
+	host      string
+	client    *httpclient.Client
+	splunkURL string
+
+	maxBatchEvents int
+	maxBatchBytes  int
+}
+
+// NewSplunkDestination ships events to a Splunk HTTP Event Collector, which
+// accepts many concatenated JSON events in a single request
+func NewSplunkDestination(
+	deployEnv string,
+	host string,
+	splunkAPIKey string,
+	splunkURL string,
+	maxBatchEvents int,
+	maxBatchBytes int,
+) Destination {
+	client := newRetryingHTTPClient(&splunkHTTPClient{
+		client:       *http.DefaultClient,
+		splunkAPIKey: splunkAPIKey,
+	})
+
+	if maxBatchEvents < 1 {
+		maxBatchEvents = 1
+	}
+
+	return &splunkDestination{
+		deployEnv,
+		host,
+		client,
+		splunkURL,
+		maxBatchEvents,
+		maxBatchBytes,
+	}
+}
+
+func (d *splunkDestination) Name() string {
+	return "splunk"
+}
+
+func (d *splunkDestination) marshalEvent(event boshdir.Event) ([]byte, error) {
+	return json.Marshal(SplunkEvent{
+		Time:       event.Timestamp().Unix(),
+		Host:       d.host,
+		SourceType: "bosh-audit-event",
+		Source:     d.deployEnv,
+		Event:      convertEvent(event),
+	})
+}
+
+func (d *splunkDestination) shipBatch(b batch) error {
+	body := make([]byte, 0, b.size)
+	for _, payload := range b.payloads {
+		body = append(body, payload...)
+		body = append(body, '\n')
+	}
+
+	BatchSizeEvents.Observe(float64(len(b.events)))
+	BatchSizeBytes.Observe(float64(len(body)))
+
+	startTime := time.Now()
+	resp, err := d.client.Post(
+		d.splunkURL,
+		bytes.NewReader(body),
+		http.Header{},
+	)
+	RequestDuration.Observe(time.Since(startTime).Seconds())
+
+	if err != nil {
+		BatchErrorsTotal.Inc()
+		return err
+	}
+	defer resp.Body.Close()
+
+	if 200 <= resp.StatusCode && resp.StatusCode < 300 {
+		return nil
+	}
+
+	BatchErrorsTotal.Inc()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("Status: %d Body: %s", resp.StatusCode, respBody)
+}
+
+func (d *splunkDestination) Ship(events []boshdir.Event) (int, error) {
+	batches, err := batchEvents(
+		events, d.marshalEvent,
+		d.maxBatchEvents, d.maxBatchBytes,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	// Only events in batches which have been acknowledged count as shipped,
+	// so a failed batch is shipped again in full on the next run
+	shipped := 0
+	for _, b := range batches {
+		if err := d.shipBatch(b); err != nil {
+			return shipped, err
+		}
+
+		shipped += len(b.events)
+		EventsShippedTotal.Add(float64(len(b.events)))
+	}
+
+	return shipped, nil
+}
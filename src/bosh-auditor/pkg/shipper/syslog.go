@@ -0,0 +1,139 @@
+package shipper
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	boshdir "github.com/cloudfoundry/bosh-cli/director"
+)
+
+const (
+	// Facility 13 is "log audit" and severity 5 is "notice"
+	syslogPriority = 13*8 + 5
+
+	syslogAppName = "bosh-auditor"
+	syslogMsgID   = "bosh-audit-event"
+
+	syslogTimeout = 5 * time.Second
+)
+
+type syslogDestination struct {
+	deployEnv string
+	network   string
+	address   string
+	hostname  string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogDestination ships each event as an RFC 5424 syslog message, whose
+// message is the JSON event. The network is either "tcp", in which case
+// messages are framed using octet counting as per RFC 6587, or "udp", in
+// which case each message is a single datagram
+func NewSyslogDestination(
+	deployEnv string,
+	network string,
+	address string,
+) (Destination, error) {
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("Syslog network must be tcp or udp, not %q", network)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	return &syslogDestination{
+		deployEnv: deployEnv,
+		network:   network,
+		address:   address,
+		hostname:  hostname,
+	}, nil
+}
+
+func (d *syslogDestination) Name() string {
+	return "syslog"
+}
+
+func (d *syslogDestination) formatEvent(event boshdir.Event) ([]byte, error) {
+	msg, err := json.Marshal(newAuditEvent(d.deployEnv, event))
+	if err != nil {
+		return nil, err
+	}
+
+	header := fmt.Sprintf(
+		"<%d>1 %s %s %s %d %s - ",
+		syslogPriority,
+		event.Timestamp().UTC().Format(time.RFC3339),
+		d.hostname,
+		syslogAppName,
+		os.Getpid(),
+		syslogMsgID,
+	)
+
+	formatted := append([]byte(header), msg...)
+
+	if d.network == "tcp" {
+		framed := []byte(fmt.Sprintf("%d ", len(formatted)))
+		return append(framed, formatted...), nil
+	}
+
+	return formatted, nil
+}
+
+func (d *syslogDestination) connect() error {
+	if d.conn != nil {
+		return nil
+	}
+
+	conn, err := net.DialTimeout(d.network, d.address, syslogTimeout)
+	if err != nil {
+		return err
+	}
+
+	d.conn = conn
+	return nil
+}
+
+func (d *syslogDestination) disconnect() {
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+}
+
+func (d *syslogDestination) Ship(events []boshdir.Event) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	if err := d.connect(); err != nil {
+		return 0, err
+	}
+
+	for i, event := range events {
+		msg, err := d.formatEvent(event)
+		if err != nil {
+			return i, err
+		}
+
+		d.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+
+		if _, err := d.conn.Write(msg); err != nil {
+			// The connection is in an unknown state, so reconnect next time
+			d.disconnect()
+			return i, err
+		}
+	}
+
+	return len(events), nil
+}
@@ -0,0 +1,139 @@
+package shipper_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	boshdir "github.com/cloudfoundry/bosh-cli/director"
+
+	s "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/shipper"
+)
+
+var rfc5424Header = regexp.MustCompile(
+	`^<109>1 1970-01-01T00:20:34Z \S+ bosh-auditor \d+ bosh-audit-event - `,
+)
+
+var _ = Describe("SyslogDestination", func() {
+	var (
+		events []boshdir.Event
+	)
+
+	BeforeEach(func() {
+		events = []boshdir.Event{
+			boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
+				ID:        "1",
+				Timestamp: 1234,
+				Action:    "delete",
+			}),
+			boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
+				ID:        "2",
+				Timestamp: 1234,
+				Action:    "create",
+			}),
+		}
+	})
+
+	checkMessage := func(msg string, id string) {
+		Expect(msg).To(MatchRegexp(rfc5424Header.String()))
+
+		var event s.AuditEvent
+		err := json.Unmarshal([]byte(rfc5424Header.ReplaceAllString(msg, "")), &event)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(event.Source).To(Equal("dev"))
+		Expect(event.Event.ID).To(Equal(id))
+	}
+
+	It("should reject unknown networks", func() {
+		_, err := s.NewSyslogDestination("dev", "carrier-pigeon", "localhost:514")
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("when using udp", func() {
+		It("should send each event as an RFC 5424 message", func() {
+			listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer listener.Close()
+
+			destination, err := s.NewSyslogDestination("dev", "udp", listener.LocalAddr().String())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(destination.Name()).To(Equal("syslog"))
+
+			shipped, err := destination.Ship(events)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shipped).To(Equal(2))
+
+			buf := make([]byte, 65536)
+			for _, id := range []string{"1", "2"} {
+				n, _, err := listener.ReadFrom(buf)
+				Expect(err).NotTo(HaveOccurred())
+				checkMessage(string(buf[:n]), id)
+			}
+		})
+	})
+
+	Context("when using tcp", func() {
+		It("should send each event framed with its length", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer listener.Close()
+
+			destination, err := s.NewSyslogDestination("dev", "tcp", listener.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+
+			received := make(chan string, 2)
+			go func() {
+				defer GinkgoRecover()
+
+				conn, err := listener.Accept()
+				Expect(err).NotTo(HaveOccurred())
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				for i := 0; i < 2; i++ {
+					length, err := reader.ReadString(' ')
+					Expect(err).NotTo(HaveOccurred())
+
+					n, err := strconv.Atoi(strings.TrimSpace(length))
+					Expect(err).NotTo(HaveOccurred())
+
+					msg := make([]byte, n)
+					_, err = io.ReadFull(reader, msg)
+					Expect(err).NotTo(HaveOccurred())
+
+					received <- string(msg)
+				}
+			}()
+
+			shipped, err := destination.Ship(events)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(shipped).To(Equal(2))
+
+			checkMessage(<-received, "1")
+			checkMessage(<-received, "2")
+		})
+	})
+
+	Context("when the destination is unavailable", func() {
+		It("should return an error", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			address := listener.Addr().String()
+			listener.Close()
+
+			destination, err := s.NewSyslogDestination("dev", "tcp", address)
+			Expect(err).NotTo(HaveOccurred())
+
+			shipped, err := destination.Ship(events)
+			Expect(err).To(HaveOccurred())
+			Expect(shipped).To(Equal(0))
+		})
+	})
+})
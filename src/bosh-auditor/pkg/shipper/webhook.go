@@ -0,0 +1,135 @@
+package shipper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+
+	boshdir "github.com/cloudfoundry/bosh-cli/director"
+	"github.com/gojektech/heimdall/httpclient"
+)
+
+// AuditEvent is the payload used by destinations which are not Splunk
+type AuditEvent struct {
+	Source string    `json:"source"`
+	Event  BoshEvent `json:"event"`
+}
+
+func newAuditEvent(deployEnv string, event boshdir.Event) AuditEvent {
+	return AuditEvent{
+		Source: deployEnv,
+		Event:  convertEvent(event),
+	}
+}
+
+type webhookHTTPClient struct {
+	client http.Client
+	token  string
+}
+
+func (c *webhookHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if c.token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.client.Do(req)
+}
+
+type webhookDestination struct {
+	deployEnv  string
+	client     *httpclient.Client
+	webhookURL string
+
+	maxBatchEvents int
+}
+
+// NewWebhookDestination ships events to a generic HTTP webhook, by POSTing
+// batches of events as a JSON array. The token is optional and is sent as a
+// bearer token
+func NewWebhookDestination(
+	deployEnv string,
+	token string,
+	webhookURL string,
+	maxBatchEvents int,
+) Destination {
+	client := newRetryingHTTPClient(&webhookHTTPClient{
+		client: *http.DefaultClient,
+		token:  token,
+	})
+
+	if maxBatchEvents < 1 {
+		maxBatchEvents = 1
+	}
+
+	return &webhookDestination{
+		deployEnv,
+		client,
+		webhookURL,
+		maxBatchEvents,
+	}
+}
+
+func (d *webhookDestination) Name() string {
+	return "webhook"
+}
+
+func (d *webhookDestination) shipBatch(b batch) error {
+	payloads := make([]json.RawMessage, 0, len(b.payloads))
+	for _, payload := range b.payloads {
+		payloads = append(payloads, payload)
+	}
+
+	body, err := json.Marshal(payloads)
+	if err != nil {
+		return err
+	}
+
+	resp, err := d.client.Post(
+		d.webhookURL,
+		bytes.NewReader(body),
+		http.Header{},
+	)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if 200 <= resp.StatusCode && resp.StatusCode < 300 {
+		return nil
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("Status: %d Body: %s", resp.StatusCode, respBody)
+}
+
+func (d *webhookDestination) Ship(events []boshdir.Event) (int, error) {
+	batches, err := batchEvents(
+		events,
+		func(event boshdir.Event) ([]byte, error) {
+			return json.Marshal(newAuditEvent(d.deployEnv, event))
+		},
+		d.maxBatchEvents, math.MaxInt32,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	shipped := 0
+	for _, b := range batches {
+		if err := d.shipBatch(b); err != nil {
+			return shipped, err
+		}
+
+		shipped += len(b.events)
+	}
+
+	return shipped, nil
+}
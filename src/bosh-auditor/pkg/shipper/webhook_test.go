@@ -0,0 +1,92 @@
+package shipper_test
+
+import (
+	"encoding/json"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	boshdir "github.com/cloudfoundry/bosh-cli/director"
+	"github.com/jarcoal/httpmock"
+
+	s "github.com/alphagov/paas-observability-release/src/bosh-auditor/pkg/shipper"
+)
+
+const (
+	webhookURL = "http://webhook.api/bosh-events"
+)
+
+var _ = Describe("WebhookDestination", func() {
+	var (
+		events []boshdir.Event
+	)
+
+	BeforeEach(func() {
+		httpmock.Reset()
+
+		events = make([]boshdir.Event, 0)
+		for _, id := range []string{"1", "2", "3"} {
+			events = append(events, boshdir.NewEventFromResp(boshdir.Client{}, boshdir.EventResp{
+				ID:        id,
+				Timestamp: 1234,
+				Action:    "some-action",
+			}))
+		}
+	})
+
+	It("should post batches of events as JSON arrays", func() {
+		received := make([][]s.AuditEvent, 0)
+
+		httpmock.RegisterResponder(
+			"POST", webhookURL,
+			func(req *http.Request) (*http.Response, error) {
+				Expect(req.Header.Get("Authorization")).To(Equal("Bearer webhook-token"))
+
+				var batch []s.AuditEvent
+				err := json.NewDecoder(req.Body).Decode(&batch)
+				Expect(err).NotTo(HaveOccurred())
+				received = append(received, batch)
+
+				return httpmock.NewStringResponse(204, ""), nil
+			},
+		)
+
+		destination := s.NewWebhookDestination("dev", "webhook-token", webhookURL, 2)
+		Expect(destination.Name()).To(Equal("webhook"))
+
+		shipped, err := destination.Ship(events)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(shipped).To(Equal(3))
+
+		Expect(received).To(HaveLen(2))
+		Expect(received[0]).To(HaveLen(2))
+		Expect(received[0][0].Source).To(Equal("dev"))
+		Expect(received[0][0].Event.ID).To(Equal("1"))
+		Expect(received[0][1].Event.ID).To(Equal("2"))
+		Expect(received[1]).To(HaveLen(1))
+		Expect(received[1][0].Event.ID).To(Equal("3"))
+		Expect(received[1][0].Event.Action).To(Equal("some-action"))
+	})
+
+	It("should report the events shipped before a failure", func() {
+		calls := 0
+
+		httpmock.RegisterResponder(
+			"POST", webhookURL,
+			func(req *http.Request) (*http.Response, error) {
+				calls++
+				if calls > 1 {
+					return httpmock.NewStringResponse(403, "forbidden"), nil
+				}
+				return httpmock.NewStringResponse(200, ""), nil
+			},
+		)
+
+		destination := s.NewWebhookDestination("dev", "", webhookURL, 2)
+
+		shipped, err := destination.Ship(events)
+		Expect(err).To(MatchError(ContainSubstring("403")))
+		Expect(shipped).To(Equal(2))
+	})
+})
@@ -0,0 +1,151 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timestamp records when a component last succeeded, for example when a
+// fetcher last fetched or a shipper last shipped. It is safe to use from
+// multiple goroutines, and the zero value has never succeeded
+type Timestamp struct {
+	mu          sync.RWMutex
+	lastSuccess time.Time
+}
+
+func (t *Timestamp) Succeeded() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastSuccess = time.Now()
+}
+
+func (t *Timestamp) LastSuccess() time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.lastSuccess
+}
+
+type check struct {
+	name        string
+	threshold   time.Duration
+	lastSuccess func() time.Time
+}
+
+// CheckStatus is the status of a single check, as served by the handlers
+type CheckStatus struct {
+	LastSuccess      *time.Time `json:"last_success"`
+	AgeSeconds       float64    `json:"age_seconds"`
+	ThresholdSeconds float64    `json:"threshold_seconds"`
+	Healthy          bool       `json:"healthy"`
+	Ready            bool       `json:"ready"`
+}
+
+// Status is the response body of /healthz and /readyz
+type Status struct {
+	Healthy bool                   `json:"healthy"`
+	Ready   bool                   `json:"ready"`
+	Checks  map[string]CheckStatus `json:"checks"`
+}
+
+// Checker serves /healthz and /readyz from the time at which each
+// registered component last succeeded.
+//
+// A process is healthy while every component has succeeded within its
+// threshold. Components which have never succeeded are given their
+// threshold from when the checker was created, so that a process is not
+// restarted before it has had a chance to succeed.
+//
+// A process is ready once every component has succeeded, and while it
+// remains healthy
+type Checker struct {
+	started time.Time
+
+	mu     sync.RWMutex
+	checks []check
+}
+
+func NewChecker() *Checker {
+	return &Checker{started: time.Now()}
+}
+
+// Register adds a check which fails when lastSuccess is older than threshold
+func (c *Checker) Register(
+	name string,
+	threshold time.Duration,
+	lastSuccess func() time.Time,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.checks = append(c.checks, check{name, threshold, lastSuccess})
+}
+
+func (c *Checker) Status() Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+
+	status := Status{
+		Healthy: true,
+		Ready:   true,
+		Checks:  make(map[string]CheckStatus),
+	}
+
+	for _, check := range c.checks {
+		checkStatus := CheckStatus{
+			ThresholdSeconds: check.threshold.Seconds(),
+		}
+
+		since := c.started
+		lastSuccess := check.lastSuccess()
+		if !lastSuccess.IsZero() {
+			since = lastSuccess
+			checkStatus.LastSuccess = &lastSuccess
+		}
+
+		age := now.Sub(since)
+		checkStatus.AgeSeconds = age.Seconds()
+		checkStatus.Healthy = age <= check.threshold
+		checkStatus.Ready = checkStatus.Healthy && !lastSuccess.IsZero()
+
+		status.Healthy = status.Healthy && checkStatus.Healthy
+		status.Ready = status.Ready && checkStatus.Ready
+		status.Checks[check.name] = checkStatus
+	}
+
+	return status
+}
+
+// Handle registers /healthz and /readyz on mux
+func (c *Checker) Handle(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := c.Status()
+		writeStatus(w, status, status.Healthy)
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := c.Status()
+		writeStatus(w, status, status.Ready)
+	})
+}
+
+func writeStatus(w http.ResponseWriter, status Status, ok bool) {
+	body, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+}
@@ -0,0 +1,88 @@
+package health_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/alphagov/paas-observability-release/src/health"
+)
+
+var _ = Describe("Checker", func() {
+	var (
+		checker *health.Checker
+		mux     *http.ServeMux
+	)
+
+	get := func(path string) (int, health.Status) {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+
+		var status health.Status
+		err := json.Unmarshal(recorder.Body.Bytes(), &status)
+		Expect(err).NotTo(HaveOccurred())
+
+		return recorder.Code, status
+	}
+
+	BeforeEach(func() {
+		checker = health.NewChecker()
+		mux = http.NewServeMux()
+		checker.Handle(mux)
+	})
+
+	It("is healthy and ready without any checks", func() {
+		code, status := get("/healthz")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(status.Healthy).To(BeTrue())
+
+		code, _ = get("/readyz")
+		Expect(code).To(Equal(http.StatusOK))
+	})
+
+	It("is healthy but not ready before a component has succeeded", func() {
+		var fetch health.Timestamp
+		checker.Register("fetch", time.Minute, fetch.LastSuccess)
+
+		code, status := get("/healthz")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(status.Checks).To(HaveKey("fetch"))
+		Expect(status.Checks["fetch"].LastSuccess).To(BeNil())
+		Expect(status.Checks["fetch"].ThresholdSeconds).To(Equal(60.0))
+
+		code, status = get("/readyz")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(status.Ready).To(BeFalse())
+
+		By("recording a success")
+		fetch.Succeeded()
+
+		code, status = get("/readyz")
+		Expect(code).To(Equal(http.StatusOK))
+		Expect(status.Checks["fetch"].LastSuccess).NotTo(BeNil())
+	})
+
+	It("is neither healthy nor ready when a component is stale", func() {
+		var fetch, ship health.Timestamp
+		checker.Register("fetch", time.Minute, fetch.LastSuccess)
+		checker.Register("ship", 10*time.Millisecond, ship.LastSuccess)
+
+		fetch.Succeeded()
+		ship.Succeeded()
+
+		Eventually(func() int {
+			code, _ := get("/healthz")
+			return code
+		}, "1s", "10ms").Should(Equal(http.StatusServiceUnavailable))
+
+		code, status := get("/readyz")
+		Expect(code).To(Equal(http.StatusServiceUnavailable))
+		Expect(status.Checks["fetch"].Healthy).To(BeTrue())
+		Expect(status.Checks["ship"].Healthy).To(BeFalse())
+		Expect(status.Checks["ship"].AgeSeconds).To(BeNumerically(">", 0.01))
+	})
+})